@@ -1,11 +1,10 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"time"
 
@@ -13,15 +12,7 @@ import (
 )
 
 func doRegister(c *cli.Context) error {
-	cfg := &Config{
-		Port:           "2222",
-		ListenAddress:  "127.0.0.1",
-		StaticPath:     "/home/gabe/src/bwproxy",
-		AppPath:        "/home/gabe/src/bwproxy/apps",
-		PortRangeStart: 8000,
-		BOSSWAVEAgent:  "",
-		UseIPv6:        false,
-	}
+	cfg := getConfig(c)
 	if c.NArg() != 2 {
 		log.Fatal("Need to specify entity file and permissions JSON file")
 	}
@@ -45,12 +36,10 @@ func doRegister(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	h := sha256.New()
-	seed := make([]byte, 16)
-	binary.PutVarint(seed, time.Now().UnixNano())
-	h.Write(seed)
-	key_bytes := h.Sum(nil)
-	key := fmt.Sprintf("%x", key_bytes)
+	key, err := newAPIKey()
+	if err != nil {
+		return err
+	}
 
 	f, err = os.Open(permissionsfile)
 	if err != nil {
@@ -61,6 +50,15 @@ func doRegister(c *cli.Context) error {
 	if err = dec.Decode(&perms); err != nil {
 		return err
 	}
+	if app := c.String("app"); app != "" {
+		perms.App = app
+	}
+	if ttl := c.Duration("ttl"); ttl > 0 {
+		perms.NotAfter = time.Now().Add(ttl)
+	}
+	if err = perms.validate(); err != nil {
+		return err
+	}
 	perms.VK = vk // add the vk
 	log.Warning("add vk", vk)
 
@@ -69,20 +67,151 @@ func doRegister(c *cli.Context) error {
 		return err
 	}
 
-	fmt.Printf("Key is: %s\n", key)
+	fmt.Printf("Key is: %s (id %s)\n", key, apiKeyID(key))
+	if !perms.NotAfter.IsZero() {
+		fmt.Printf("Expires: %s\n", perms.NotAfter.Format(time.RFC3339))
+	}
 	return nil
 }
 
 func runProxy(c *cli.Context) error {
-	cfg := &Config{
-		Port:           "2222",
-		ListenAddress:  "127.0.0.1",
-		StaticPath:     "/home/gabe/src/bwproxy",
-		AppPath:        "/home/gabe/src/bwproxy/apps",
-		PortRangeStart: 8000,
-		BOSSWAVEAgent:  "",
-		UseIPv6:        false,
-	}
+	cfg := getConfig(c)
 	startProxyServer(cfg)
 	return nil
 }
+
+// the key commands go through the admin API, so they work while the proxy holds
+// the registry open and need no BOSSWAVE agent
+func listKeys(c *cli.Context) error {
+	cfg := getConfig(c)
+	body, err := adminRequest(cfg, "GET", "/api/keys", nil)
+	if err != nil {
+		return err
+	}
+	var perms []Permissions
+	if err := json.Unmarshal(body, &perms); err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		fmt.Printf("%s vk=%s subscribe=%v publish=%v query=%v list=%v", perm.ID, perm.VK, perm.Subscribe.Allowed, perm.Publish.Allowed, perm.Query.Allowed, perm.List.Allowed)
+		if perm.App != "" {
+			fmt.Printf(" app=%s", perm.App)
+		}
+		if !perm.NotAfter.IsZero() {
+			fmt.Printf(" expires=%s", perm.NotAfter.Format(time.RFC3339))
+		}
+		fmt.Println()
+	}
+	return nil
+}
+
+func showKey(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify API key")
+	}
+	body, err := adminRequest(cfg, "GET", "/api/keys/"+url.PathEscape(resolveKeyID(c.Args().Get(0))), nil)
+	if err != nil {
+		return err
+	}
+	var perms Permissions
+	if err := json.Unmarshal(body, &perms); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(perms, "", "    ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+func revokeKey(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify API key")
+	}
+	id := resolveKeyID(c.Args().Get(0))
+	if _, err := adminRequest(cfg, "DELETE", "/api/keys/"+url.PathEscape(id), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Revoked key %s\n", id)
+	return nil
+}
+
+func rotateKey(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify API key")
+	}
+	id := resolveKeyID(c.Args().Get(0))
+	grace := c.Duration("grace")
+	query := url.Values{"grace": {grace.String()}}
+	body, err := adminRequest(cfg, "POST", "/api/keys/"+url.PathEscape(id)+"/rotate?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	var resp struct{ Key, ID string }
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return err
+	}
+	if grace > 0 {
+		body, err := adminRequest(cfg, "GET", "/api/keys/"+url.PathEscape(id), nil)
+		if err != nil {
+			return err
+		}
+		var old Permissions
+		if err := json.Unmarshal(body, &old); err != nil {
+			return err
+		}
+		fmt.Printf("Old key %s valid until %s\n", id, old.NotAfter.Format(time.RFC3339))
+	} else {
+		fmt.Printf("Revoked key %s\n", id)
+	}
+	fmt.Printf("Key is: %s (id %s)\n", resp.Key, resp.ID)
+	return nil
+}
+
+func stopApp(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify app name")
+	}
+	name := c.Args().Get(0)
+	if _, err := adminRequest(cfg, "POST", "/api/apps/"+url.PathEscape(name)+"/stop", nil); err != nil {
+		return err
+	}
+	fmt.Printf("Stopped %s\n", name)
+	return nil
+}
+
+func restartApp(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify app name")
+	}
+	name := c.Args().Get(0)
+	body, err := adminRequest(cfg, "POST", "/api/apps/"+url.PathEscape(name)+"/restart", nil)
+	if err != nil {
+		return err
+	}
+	var resp struct{ Address string }
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return err
+	}
+	fmt.Printf("Restarted %s on %s\n", name, resp.Address)
+	return nil
+}
+
+func uninstallApp(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify app name")
+	}
+	name := c.Args().Get(0)
+	if _, err := adminRequest(cfg, "DELETE", "/api/apps/"+url.PathEscape(name), nil); err != nil {
+		return err
+	}
+	fmt.Printf("Uninstalled %s\n", name)
+	return nil
+}
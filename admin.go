@@ -0,0 +1,433 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// The admin server listens on its own address and port so that apps (which are
+// served from other origins) cannot reach it. Every request must present the admin
+// credential as a bearer token. The admin UI also accepts it as the password for
+// HTTP basic auth, so that it works from a browser
+func (srv *proxyServer) startAdminServer(cfg *Config) {
+	srv.adminRouter = httprouter.New()
+	srv.adminRouter.ServeFiles("/static/*filepath", http.Dir(srv.staticpath))
+
+	// admin UI
+	srv.adminRouter.GET("/", srv.adminUIAuth(srv.phoneHome))
+	srv.adminRouter.GET("/browse", srv.adminUIAuth(srv.browse))
+
+	// app browsing/management
+	srv.adminRouter.GET("/apps/list", srv.adminUIAuth(srv.listApps))
+	srv.adminRouter.POST("/apps/start/:name", srv.adminUIAuth(srv.startApp))
+
+	// JSON API
+	srv.adminRouter.GET("/api/keys", srv.adminAuth(srv.adminListKeys))
+	srv.adminRouter.POST("/api/keys", srv.adminAuth(srv.adminAddKey))
+	srv.adminRouter.GET("/api/keys/:id", srv.adminAuth(srv.adminShowKey))
+	srv.adminRouter.DELETE("/api/keys/:id", srv.adminAuth(srv.adminRevokeKey))
+	srv.adminRouter.PUT("/api/keys/:id/permissions", srv.adminAuth(srv.adminSetPermissions))
+	srv.adminRouter.POST("/api/keys/:id/rotate", srv.adminAuth(srv.adminRotateKey))
+	srv.adminRouter.GET("/api/entities", srv.adminAuth(srv.adminListEntities))
+	srv.adminRouter.POST("/api/entities", srv.adminAuth(srv.adminAddEntity))
+	srv.adminRouter.DELETE("/api/entities/:vk", srv.adminAuth(srv.adminRemoveEntity))
+	srv.adminRouter.GET("/api/apps", srv.adminAuth(srv.listApps))
+	srv.adminRouter.POST("/api/apps", srv.adminAuth(srv.adminInstallApp))
+	srv.adminRouter.DELETE("/api/apps/:name", srv.adminAuth(srv.adminUninstallApp))
+	srv.adminRouter.POST("/api/apps/:name/start", srv.adminAuth(srv.startApp))
+	srv.adminRouter.POST("/api/apps/:name/stop", srv.adminAuth(srv.adminStopApp))
+	srv.adminRouter.POST("/api/apps/:name/restart", srv.adminAuth(srv.adminRestartApp))
+	srv.adminRouter.POST("/api/apps/:name/grant", srv.adminAuth(srv.adminGrantApp))
+	srv.adminRouter.GET("/api/apps/:name/config", srv.adminAuth(srv.adminShowAppConfig))
+	srv.adminRouter.PUT("/api/apps/:name/config/:option", srv.adminAuth(srv.adminSetAppConfig))
+	srv.adminRouter.DELETE("/api/apps/:name/config/:option", srv.adminAuth(srv.adminUnsetAppConfig))
+	srv.adminRouter.GET("/api/apps/:name/storage", srv.adminAuth(srv.adminExportStorage))
+	srv.adminRouter.PUT("/api/apps/:name/storage", srv.adminAuth(srv.adminImportStorage))
+
+	var addrString string
+	if cfg.UseIPv6 {
+		addrString = "[" + cfg.AdminListenAddress + "]:" + cfg.AdminPort
+	} else {
+		addrString = cfg.AdminListenAddress + ":" + cfg.AdminPort
+	}
+
+	if srv.adminCredential == "" {
+		key, err := newAPIKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.adminCredential = key
+		// printed once rather than logged, so it doesn't end up in log files
+		fmt.Fprintf(os.Stderr, "No AdminCredential configured; using generated credential %s\n", srv.adminCredential)
+	}
+
+	log.Notice("Starting admin HTTP Server on ", addrString)
+	server := &http.Server{
+		Addr:              addrString,
+		Handler:           srv.adminRouter,
+		ReadHeaderTimeout: requestHeaderTimeout,
+		ReadTimeout:       requestReadTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	go func() {
+		log.Fatal(server.ListenAndServe())
+	}()
+}
+
+func (srv *proxyServer) isAdminCredential(credential string) bool {
+	return credential != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(srv.adminCredential)) == 1
+}
+
+// only runs the handler if the request carries the admin credential as a bearer
+// token. Browsers never add one by themselves, so pages elsewhere cannot make these
+// requests with credentials the browser has cached
+func (srv *proxyServer) adminAuth(handle httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if !srv.isAdminCredential(bearerKey(req)) {
+			adminError(rw, http.StatusUnauthorized, errors.New("Invalid admin credential"))
+			return
+		}
+		handle(rw, req, ps)
+	}
+}
+
+// like adminAuth, but also accepts the credential as the basic auth password. The
+// browser sends cached basic auth credentials no matter which page makes the
+// request, so those are only accepted from the admin UI's own pages
+func (srv *proxyServer) adminUIAuth(handle httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if srv.isAdminCredential(bearerKey(req)) {
+			handle(rw, req, ps)
+			return
+		}
+		if _, password, ok := req.BasicAuth(); !ok || !srv.isAdminCredential(password) {
+			rw.Header().Set("WWW-Authenticate", `Basic realm="bwproxy admin"`)
+			adminError(rw, http.StatusUnauthorized, errors.New("Invalid admin credential"))
+			return
+		}
+		if !fromAdminUI(req) {
+			adminError(rw, http.StatusForbidden, errors.Errorf("Rejecting %s %s from another origin", req.Method, req.URL.Path))
+			return
+		}
+		handle(rw, req, ps)
+	}
+}
+
+// whether the request came from a page served by the admin server: its Origin (or
+// Referer) must be the host the request was sent to. Requests carrying neither are
+// only accepted if they change nothing, e.g. opening the UI in a new tab
+func fromAdminUI(req *http.Request) bool {
+	source := req.Header.Get("Origin")
+	if source == "" {
+		source = req.Header.Get("Referer")
+	}
+	if source == "" {
+		return req.Method == "GET" || req.Method == "HEAD"
+	}
+	u, err := url.Parse(source)
+	return err == nil && u.Host == req.Host
+}
+
+func adminError(rw http.ResponseWriter, status int, err error) {
+	log.Error(err)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(map[string]string{"Error": err.Error()})
+}
+
+func adminJSON(rw http.ResponseWriter, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Error(errors.Wrap(err, "Could not write admin response"))
+	}
+}
+
+func (srv *proxyServer) adminListKeys(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	perms, err := srv.registry.listPermissions()
+	if err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	if perms == nil {
+		perms = []Permissions{}
+	}
+	adminJSON(rw, perms)
+}
+
+func (srv *proxyServer) adminShowKey(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	perms, err := srv.registry.getPermissionsByID(ps.ByName("id"))
+	if err != nil {
+		adminError(rw, 404, err)
+		return
+	}
+	adminJSON(rw, perms)
+}
+
+type adminAddKeyRequest struct {
+	// vk of a previously added entity
+	VK          string
+	Permissions Permissions
+	// optional lifetime of the key, e.g. "72h"
+	TTL string
+}
+
+// registers a new API key for an existing entity and returns the key
+func (srv *proxyServer) adminAddKey(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var addreq adminAddKeyRequest
+	if err := json.NewDecoder(req.Body).Decode(&addreq); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	if srv.registry.getClientForVK(addreq.VK) == nil {
+		adminError(rw, 400, errors.Errorf("No loaded entity with vk %s", addreq.VK))
+		return
+	}
+	perms := addreq.Permissions
+	perms.VK = addreq.VK
+	if addreq.TTL != "" {
+		ttl, err := time.ParseDuration(addreq.TTL)
+		if err != nil {
+			adminError(rw, 400, errors.Wrap(err, "Invalid TTL"))
+			return
+		}
+		perms.NotAfter = time.Now().Add(ttl)
+	}
+	if err := perms.validate(); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	key, err := newAPIKey()
+	if err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	if err := srv.registry.addPermissions(key, perms); err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	adminJSON(rw, map[string]string{"Key": key, "ID": apiKeyID(key)})
+}
+
+func (srv *proxyServer) adminRevokeKey(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	if err := srv.registry.revokeKey(ps.ByName("id")); err != nil {
+		adminError(rw, 404, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// replaces the permissions of a key. The VK of the key and the app it is bound to
+// cannot be changed
+func (srv *proxyServer) adminSetPermissions(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	id := ps.ByName("id")
+	current, err := srv.registry.getPermissionsByID(id)
+	if err != nil {
+		adminError(rw, 404, err)
+		return
+	}
+	var perms Permissions
+	if err := json.NewDecoder(req.Body).Decode(&perms); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	perms.VK = current.VK
+	perms.App = current.App
+	if err := perms.validate(); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	if err := srv.registry.updatePermissions(id, perms); err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	perms.ID = id
+	adminJSON(rw, perms)
+}
+
+// issues a replacement key; the optional grace query parameter (e.g. "24h") keeps
+// the old key working for that long
+func (srv *proxyServer) adminRotateKey(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var grace time.Duration
+	if g := req.URL.Query().Get("grace"); g != "" {
+		var err error
+		if grace, err = time.ParseDuration(g); err != nil {
+			adminError(rw, 400, errors.Wrap(err, "Invalid grace period"))
+			return
+		}
+	}
+	key, err := srv.registry.rotateKey(ps.ByName("id"), grace)
+	if err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	adminJSON(rw, map[string]string{"Key": key, "ID": apiKeyID(key)})
+}
+
+func (srv *proxyServer) adminListEntities(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	vks, err := srv.registry.listEntities()
+	if err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	if vks == nil {
+		vks = []string{}
+	}
+	adminJSON(rw, vks)
+}
+
+// the request body is the contents of an entity file
+func (srv *proxyServer) adminAddEntity(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	contents, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	vk, err := srv.registry.addAndLoadEntity(contents)
+	if err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	adminJSON(rw, map[string]string{"VK": vk})
+}
+
+func (srv *proxyServer) adminRemoveEntity(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	if err := srv.registry.removeEntity(ps.ByName("vk")); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// the request body is a zip or tar.gz bundle. Pass ?upgrade=true to replace an
+// installed app, and ?grant=<vk> to grant the app the permissions its manifest requests
+func (srv *proxyServer) adminInstallApp(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+
+	tmp, err := ioutil.TempFile("", "bwproxy-bundle-")
+	if err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, http.MaxBytesReader(rw, req.Body, maxBundleSize))
+	tmp.Close()
+	if err != nil {
+		adminError(rw, 400, errors.Wrap(err, "Could not read bundle"))
+		return
+	}
+
+	manifest, err := installBundle(srv.apppath, tmp.Name(), req.URL.Query().Get("upgrade") == "true")
+	if err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	// grant the requested permissions at install time
+	if vk := req.URL.Query().Get("grant"); vk != "" {
+		if _, err := grantApp(srv.registry, srv.apppath, manifest.Name, vk, nil); err != nil {
+			adminError(rw, 400, errors.Wrap(err, "Installed app, but could not grant permissions"))
+			return
+		}
+	}
+	adminJSON(rw, manifest)
+}
+
+func (srv *proxyServer) adminStopApp(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	if err := srv.stopApp(ps.ByName("name")); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (srv *proxyServer) adminRestartApp(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	app, err := srv.restartApp(ps.ByName("name"))
+	if err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	adminJSON(rw, map[string]string{"Address": srv.appAddress(app)})
+}
+
+func (srv *proxyServer) adminUninstallApp(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	if err := srv.uninstallApp(ps.ByName("name")); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// performs a request against the admin API of a running proxy and returns the body
+// of the response. Used by CLI commands that act on the running proxy
+func adminRequest(cfg *Config, method, path string, body io.Reader) ([]byte, error) {
+	if cfg.AdminCredential == "" {
+		return nil, errors.New("AdminCredential must be configured to manage the running proxy")
+	}
+	target := "http://" + net.JoinHostPort(cfg.AdminListenAddress, cfg.AdminPort) + path
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminCredential)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not reach admin server")
+	}
+	defer resp.Body.Close()
+	respbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		var apierr struct{ Error string }
+		if json.Unmarshal(respbody, &apierr) == nil && apierr.Error != "" {
+			return nil, errors.New(apierr.Error)
+		}
+		return nil, errors.Errorf("Admin server returned %s", resp.Status)
+	}
+	return respbody, nil
+}
+
+type adminGrantRequest struct {
+	// vk of the entity the app's key uses
+	VK string
+	// permissions to grant; defaults to the permissions requested by the manifest
+	Permissions *Permissions
+}
+
+func (srv *proxyServer) adminGrantApp(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	var grantreq adminGrantRequest
+	if err := json.NewDecoder(req.Body).Decode(&grantreq); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	id, err := grantApp(srv.registry, srv.apppath, ps.ByName("name"), grantreq.VK, grantreq.Permissions)
+	if err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	adminJSON(rw, map[string]string{"ID": id})
+}
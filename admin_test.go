@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestAdminAuth(t *testing.T) {
+	srv := &proxyServer{adminCredential: "admin secret"}
+	ok := func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {}
+
+	for _, test := range []struct {
+		name   string
+		ui     bool
+		method string
+		// Authorization header, Origin and Referer
+		auth, origin, referer string
+		status                int
+	}{
+		{"api, bearer", false, "POST", "Bearer admin secret", "", "", 200},
+		{"api, wrong bearer", false, "POST", "Bearer wrong", "", "", 401},
+		{"api, no credential", false, "GET", "", "", "", 401},
+		{"api, basic auth", false, "POST", "basic", "http://localhost:2223", "", 401},
+		{"api, basic auth from an app", false, "POST", "basic", "http://localhost:8000", "", 401},
+		{"ui, bearer", true, "POST", "Bearer admin secret", "", "", 200},
+		{"ui, basic auth", true, "GET", "basic", "", "", 200},
+		{"ui, basic auth from the ui", true, "POST", "basic", "http://localhost:2223", "", 200},
+		{"ui, basic auth with referer", true, "POST", "basic", "", "http://localhost:2223/browse", 200},
+		{"ui, basic auth from an app", true, "POST", "basic", "http://localhost:8000", "", 403},
+		{"ui, basic auth with app referer", true, "GET", "basic", "", "http://demo.bw.local:2222/", 403},
+		{"ui, basic auth from a sandboxed page", true, "POST", "basic", "null", "", 403},
+		{"ui, basic auth without origin", true, "POST", "basic", "", "", 403},
+		{"ui, wrong password", true, "GET", "wrong basic", "", "", 401},
+		{"ui, no credential", true, "GET", "", "", "", 401},
+	} {
+		req := httptest.NewRequest(test.method, "http://localhost:2223/apps/start/demo", nil)
+		switch test.auth {
+		case "basic":
+			req.SetBasicAuth("admin", "admin secret")
+		case "wrong basic":
+			req.SetBasicAuth("admin", "wrong")
+		case "":
+		default:
+			req.Header.Set("Authorization", test.auth)
+		}
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if test.referer != "" {
+			req.Header.Set("Referer", test.referer)
+		}
+		handle := srv.adminAuth(ok)
+		if test.ui {
+			handle = srv.adminUIAuth(ok)
+		}
+		rw := httptest.NewRecorder()
+		handle(rw, req, nil)
+		if rw.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, rw.Code, test.status)
+		}
+	}
+}
+
+// changing the permissions of an app's key leaves it bound to the app
+func TestAdminSetPermissionsKeepsApp(t *testing.T) {
+	srv, keyA, _ := newTestProxy(t)
+	id := apiKeyID(keyA)
+	req := httptest.NewRequest("PUT", "http://localhost:2223/api/keys/"+id+"/permissions",
+		strings.NewReader(`{"VK": "other vk", "App": "", "Publish": {"Allowed": true}}`))
+	rw := httptest.NewRecorder()
+	srv.adminSetPermissions(rw, req, httprouter.Params{{Key: "id", Value: id}})
+	if rw.Code != 200 {
+		t.Fatalf("got %d: %s", rw.Code, rw.Body)
+	}
+	perms, err := srv.registry.getPermissionsByID(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perms.App != "a" || perms.VK != "" || !perms.Publish.Allowed || perms.Query.Allowed {
+		t.Errorf("got %+v", perms)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// An app's configuration is a JSON object. The manifest's Config declares the options
+// the app accepts, along with their type and default. The admin sets values for an
+// installed app (stored in the registry), and the app reads the result from /config
+type configOption struct {
+	// one of string, number, integer, boolean, array or object
+	Type        string
+	Default     interface{} `json:",omitempty"`
+	Description string      `json:",omitempty"`
+}
+
+// checks that the value (as decoded from JSON) is of the option's type
+func (opt configOption) check(value interface{}) error {
+	var ok bool
+	switch opt.Type {
+	case "string":
+		_, ok = value.(string)
+	case "number":
+		_, ok = value.(float64)
+	case "integer":
+		f, isnum := value.(float64)
+		ok = isnum && f == math.Trunc(f)
+	case "boolean":
+		_, ok = value.(bool)
+	case "array":
+		_, ok = value.([]interface{})
+	case "object":
+		_, ok = value.(map[string]interface{})
+	default:
+		return errors.Errorf("Unknown type %q", opt.Type)
+	}
+	if !ok {
+		return errors.Errorf("Expected %s, got %s", opt.Type, jsonString(value))
+	}
+	return nil
+}
+
+func jsonString(value interface{}) string {
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+var configTypes = map[string]bool{
+	"string": true, "number": true, "integer": true, "boolean": true, "array": true, "object": true,
+}
+
+// checks the config schema declared in a manifest
+func validateConfigSchema(schema map[string]configOption) []error {
+	var errs []error
+	for name, opt := range schema {
+		if !configTypes[opt.Type] {
+			errs = append(errs, errors.Errorf("Config option %s has unknown type %q", name, opt.Type))
+			continue
+		}
+		if opt.Default == nil {
+			continue
+		}
+		if err := opt.check(opt.Default); err != nil {
+			errs = append(errs, errors.Wrapf(err, "Invalid default for Config option %s", name))
+		}
+	}
+	return errs
+}
+
+// checks a value to be stored for the named option of the app
+func (manifest appManifest) checkConfigValue(name string, value interface{}) error {
+	opt, found := manifest.Config[name]
+	if !found {
+		return errors.Errorf("App %s has no config option %s", manifest.Name, name)
+	}
+	return errors.Wrapf(opt.check(value), "Invalid value for config option %s", name)
+}
+
+// returns the app's effective configuration: the defaults from the manifest,
+// overridden by the values set by the admin. Stored values for options that are
+// no longer in the manifest (or no longer of the right type) are ignored
+func (manifest appManifest) resolveConfig(values map[string]interface{}) map[string]interface{} {
+	config := make(map[string]interface{})
+	for name, opt := range manifest.Config {
+		if value, found := values[name]; found && opt.check(value) == nil {
+			config[name] = value
+		} else if opt.Default != nil {
+			config[name] = opt.Default
+		}
+	}
+	return config
+}
+
+// serves the app's effective configuration
+func (app *appServer) serveConfig(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	values, err := app.proxy.registry.getAppConfig(app.name)
+	if err != nil {
+		log.Error(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-cache")
+	if err := json.NewEncoder(rw).Encode(app.manifest.resolveConfig(values)); err != nil {
+		log.Error(errors.Wrap(err, "Could not write config response"))
+	}
+}
+
+// the configuration of an app as shown to the admin
+type appConfigListing struct {
+	// options declared by the manifest
+	Schema map[string]configOption
+	// values set by the admin
+	Values map[string]interface{}
+	// what the app sees at /config
+	Config map[string]interface{}
+}
+
+func (srv *proxyServer) loadAppConfig(name string) (appManifest, appConfigListing, error) {
+	var listing appConfigListing
+	if name == "" || badPathMatch.MatchString(name) {
+		return appManifest{}, listing, errors.New("Invalid app name " + name)
+	}
+	manifest, err := loadManifest(filepath.Join(srv.apppath, name, "manifest.json"))
+	if err != nil {
+		return manifest, listing, err
+	}
+	values, err := srv.registry.getAppConfig(name)
+	if err != nil {
+		return manifest, listing, err
+	}
+	listing.Schema = manifest.Config
+	listing.Values = values
+	listing.Config = manifest.resolveConfig(values)
+	return manifest, listing, nil
+}
+
+func (srv *proxyServer) adminShowAppConfig(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	_, listing, err := srv.loadAppConfig(ps.ByName("name"))
+	if err != nil {
+		adminError(rw, 404, err)
+		return
+	}
+	adminJSON(rw, listing)
+}
+
+// the request body is the JSON value of the option
+func (srv *proxyServer) adminSetAppConfig(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	name, option := ps.ByName("name"), ps.ByName("option")
+	manifest, _, err := srv.loadAppConfig(name)
+	if err != nil {
+		adminError(rw, 404, err)
+		return
+	}
+	var value interface{}
+	if err := json.NewDecoder(req.Body).Decode(&value); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	if err := manifest.checkConfigValue(option, value); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	if err := srv.registry.setAppConfigValue(name, option, value); err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	_, listing, err := srv.loadAppConfig(name)
+	if err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	adminJSON(rw, listing)
+}
+
+// removes the value set for the option, so the app sees the default again
+func (srv *proxyServer) adminUnsetAppConfig(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	name := ps.ByName("name")
+	if _, _, err := srv.loadAppConfig(name); err != nil {
+		adminError(rw, 404, err)
+		return
+	}
+	if err := srv.registry.unsetAppConfigValue(name, ps.ByName("option")); err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func showAppConfig(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify app name")
+	}
+	body, err := adminRequest(cfg, "GET", "/api/apps/"+url.PathEscape(c.Args().Get(0))+"/config", nil)
+	if err != nil {
+		return err
+	}
+	var listing appConfigListing
+	if err := json.Unmarshal(body, &listing); err != nil {
+		return err
+	}
+	var names []string
+	for name := range listing.Schema {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		opt := listing.Schema[name]
+		source := "default"
+		if _, set := listing.Values[name]; set {
+			source = "set"
+		}
+		fmt.Printf("%s (%s) = %s [%s]\n", name, opt.Type, jsonString(listing.Config[name]), source)
+		if opt.Description != "" {
+			fmt.Printf("    %s\n", opt.Description)
+		}
+	}
+	return nil
+}
+
+// the value is parsed as JSON; anything that isn't valid JSON is taken as a string
+func setAppConfig(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 3 {
+		log.Fatal("Need to specify app name, option and value")
+	}
+	name, option, value := c.Args().Get(0), c.Args().Get(1), c.Args().Get(2)
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(value), &parsed); err != nil {
+		parsed = value
+	}
+	path := "/api/apps/" + url.PathEscape(name) + "/config/" + url.PathEscape(option)
+	if _, err := adminRequest(cfg, "PUT", path, bytes.NewBufferString(jsonString(parsed))); err != nil {
+		return err
+	}
+	fmt.Printf("Set %s %s = %s\n", name, option, jsonString(parsed))
+	return nil
+}
+
+func unsetAppConfig(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 2 {
+		log.Fatal("Need to specify app name and option")
+	}
+	name, option := c.Args().Get(0), c.Args().Get(1)
+	path := "/api/apps/" + url.PathEscape(name) + "/config/" + url.PathEscape(option)
+	if _, err := adminRequest(cfg, "DELETE", path, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Unset %s %s\n", name, option)
+	return nil
+}
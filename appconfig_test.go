@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// decodes the value as the registry and the admin API do
+func decodeJSON(t *testing.T, s string) interface{} {
+	var value interface{}
+	if err := json.Unmarshal([]byte(s), &value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestConfigOptionCheck(t *testing.T) {
+	for _, test := range []struct {
+		typ   string
+		value string
+		ok    bool
+	}{
+		{"string", `"scratch.ns"`, true},
+		{"string", `""`, true},
+		{"string", `1`, false},
+		{"string", `null`, false},
+		{"number", `1.5`, true},
+		{"number", `-3`, true},
+		{"number", `"1"`, false},
+		{"integer", `3`, true},
+		{"integer", `3.0`, true},
+		{"integer", `3.5`, false},
+		{"integer", `true`, false},
+		{"boolean", `false`, true},
+		{"boolean", `0`, false},
+		{"array", `[1, "a"]`, true},
+		{"array", `[]`, true},
+		{"array", `{}`, false},
+		{"object", `{"a": 1}`, true},
+		{"object", `[]`, false},
+		{"date", `"2017-01-01"`, false},
+	} {
+		err := configOption{Type: test.typ}.check(decodeJSON(t, test.value))
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s: %v, want ok=%v", test.typ, test.value, err, test.ok)
+		}
+	}
+}
+
+func TestValidateConfigSchema(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		schema map[string]configOption
+		errors int
+	}{
+		{"empty", nil, 0},
+		{"no defaults", map[string]configOption{"a": {Type: "string"}, "b": {Type: "object"}}, 0},
+		{"good defaults", map[string]configOption{"a": {Type: "integer", Default: 2.0}, "b": {Type: "boolean", Default: true}}, 0},
+		{"unknown type", map[string]configOption{"a": {Type: "date"}}, 1},
+		{"missing type", map[string]configOption{"a": {}}, 1},
+		{"bad default", map[string]configOption{"a": {Type: "string", Default: 1.0}, "b": {Type: "array", Default: "x"}}, 2},
+	} {
+		if errs := validateConfigSchema(test.schema); len(errs) != test.errors {
+			t.Errorf("%s: got errors %v, want %d", test.name, errs, test.errors)
+		}
+	}
+}
+
+func TestResolveConfig(t *testing.T) {
+	manifest := appManifest{
+		Name: "demo",
+		Config: map[string]configOption{
+			"uri":      {Type: "string", Default: "scratch.ns/demo"},
+			"interval": {Type: "integer", Default: 10.0},
+			"labels":   {Type: "array"},
+		},
+	}
+
+	if err := manifest.checkConfigValue("interval", decodeJSON(t, `30`)); err != nil {
+		t.Error(err)
+	}
+	if err := manifest.checkConfigValue("interval", decodeJSON(t, `"30"`)); err == nil {
+		t.Error("accepted a string for an integer option")
+	}
+	if err := manifest.checkConfigValue("unknown", decodeJSON(t, `1`)); err == nil {
+		t.Error("accepted a value for an unknown option")
+	}
+
+	for _, test := range []struct {
+		name   string
+		values string
+		want   string
+	}{
+		{"defaults", `{}`, `{"uri": "scratch.ns/demo", "interval": 10}`},
+		{"overridden", `{"uri": "scratch.ns/other", "labels": ["a"]}`, `{"uri": "scratch.ns/other", "interval": 10, "labels": ["a"]}`},
+		// values left over from an older manifest are dropped
+		{"stale values", `{"interval": "often", "removed": 1}`, `{"uri": "scratch.ns/demo", "interval": 10}`},
+	} {
+		values := decodeJSON(t, test.values).(map[string]interface{})
+		got := manifest.resolveConfig(values)
+		if want := decodeJSON(t, test.want); !reflect.DeepEqual(interface{}(got), want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, want)
+		}
+	}
+}
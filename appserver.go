@@ -1,64 +1,93 @@
 package main
 
 import (
+	"context"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 )
 
 type appServer struct {
 	running bool
 
+	// name of the app
+	name string
 	port string
 	// filesystem path where the app is located
 	root string
 	// permission key
 	key string
+	// the app's manifest
+	manifest appManifest
 
 	// router
 	router *httprouter.Router
 	// for proxy server calls
 	proxy *proxyServer
+	// the app's HTTP server
+	server *http.Server
+	// closed when the app is stopped, to cancel open subscriptions
+	done chan struct{}
 }
 
 type appConfig struct {
+	name          string
 	port          string
 	useipv6       bool
 	listenaddress string
 	root          string
+	manifest      appManifest
 	proxy         *proxyServer
 }
 
-type appManifest struct {
-	Name        string
-	Description string
-	Version     string
-	// not going to be populated by the manifest
-	Address string
-}
-
-func startAppServer(cfg *appConfig) *appServer {
+// creates the app and its router without starting a listener for it; used when apps
+// are served through the proxy server's port
+func newAppServer(cfg *appConfig) *appServer {
 	app := &appServer{
-		running: false,
-		port:    cfg.port,
-		root:    cfg.root,
-		proxy:   cfg.proxy,
+		running:  false,
+		name:     cfg.name,
+		port:     cfg.port,
+		root:     cfg.root,
+		manifest: cfg.manifest,
+		proxy:    cfg.proxy,
+		done:     make(chan struct{}),
 	}
 	app.router = httprouter.New()
 	log.Debug(app.root)
 	log.Debugf("%+v", http.Dir(app.root))
 	app.router.ServeFiles("/static/*filepath", http.Dir(app.root))
 
-	// serve app's index.html
+	// serve app's entry point
 	app.router.GET("/", app.index)
 
 	// pass through
-	app.router.GET("/streaming", app.proxy.doStreamingCall)
-	app.router.POST("/call", app.proxy.doCall)
+	app.router.GET("/streaming", app.withApp(app.proxy.doStreamingCall))
+	app.router.POST("/call", app.withApp(app.proxy.doCall))
+	app.router.GET("/events", app.withApp(app.proxy.doEvents))
+	app.router.POST("/events", app.withApp(app.proxy.issueEventToken))
+	app.router.POST("/rpc", app.withApp(app.proxy.doJSONRPC))
+	// the app's configuration
+	app.router.GET("/config", app.withAppData(app.serveConfig))
+	// the app's key/value storage
+	app.router.GET("/storage", app.withAppData(app.listStorage))
+	app.router.GET("/storage/*key", app.withAppData(app.getStorage))
+	app.router.PUT("/storage/*key", app.withAppData(app.putStorage))
+	app.router.DELETE("/storage/*key", app.withAppData(app.deleteStorage))
 	// serve the bw2lib.js file
 	app.router.GET("/js/bw2lib.js", app.serveJS)
 
+	app.running = true
+	return app
+}
+
+// creates the app and starts a listener for it on its own port
+func startAppServer(cfg *appConfig) (*appServer, error) {
+	app := newAppServer(cfg)
+
 	// configure server
 	var (
 		addrString string
@@ -76,27 +105,135 @@ func startAppServer(cfg *appConfig) *appServer {
 
 	address, err := net.ResolveTCPAddr(nettype, addrString)
 	if err != nil {
-		log.Fatalf("Error resolving address %s (%s)", addrString, err.Error())
+		return nil, errors.Wrapf(err, "Error resolving address %s", addrString)
+	}
+
+	listener, err := net.Listen(nettype, address.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not listen on %s", addrString)
 	}
 
 	log.Notice("Starting HTTP Server on ", addrString)
 
+	app.server = &http.Server{
+		Handler:           app.router,
+		ReadHeaderTimeout: requestHeaderTimeout,
+		ReadTimeout:       requestReadTimeout,
+		IdleTimeout:       idleTimeout,
+	}
 	go func() {
-		http.ListenAndServe(address.String(), app.router)
+		if err := app.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error(errors.Wrapf(err, "App %s server failed", app.name))
+		}
 	}()
 
-	app.running = true
-	return app
+	return app, nil
 }
 
-func (app *appServer) stop() {
+type appContextKey struct{}
+
+// set on requests routed to an app by path prefix; holds the prefix (/a/<app>/)
+type appPrefixContextKey struct{}
+
+// marks requests passed through to the proxy server as coming from this app
+func (app *appServer) withApp(handle httprouter.Handle) httprouter.Handle {
+	return func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		// requests through the app are authorized as the app, so only accept them
+		// from the app's own pages, sent to the app's own address
+		if !app.servesHost(req.Context(), req.Host) {
+			log.Errorf("Rejecting request to app %s for host %s", app.name, req.Host)
+			rw.WriteHeader(403)
+			rw.Write([]byte("Requests must be sent to the app's own address"))
+			return
+		}
+		if origin := req.Header.Get("Origin"); origin != "" {
+			if u, err := url.Parse(origin); err != nil || u.Host != req.Host {
+				log.Errorf("Rejecting request to app %s from origin %s", app.name, origin)
+				rw.WriteHeader(403)
+				rw.Write([]byte("Cross-origin requests are not allowed"))
+				return
+			}
+		}
+		ctx, cancel := context.WithCancel(context.WithValue(req.Context(), appContextKey{}, app.name))
+		defer cancel()
+		// cancel long running requests (subscriptions) when the app is stopped
+		go func() {
+			select {
+			case <-app.done:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		handle(rw, req.WithContext(ctx), ps)
+	}
+}
+
+// whether the host (from the Host header) is an address the app is served at.
+// Otherwise a page could rebind its own domain name to the app's address and, with
+// matching Origin and Host headers, act as the app
+func (app *appServer) servesHost(ctx context.Context, hostport string) bool {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil || port != app.port {
+		return false
+	}
+	host = strings.ToLower(host)
+	if app.proxy.sharedPort && appPrefixFromContext(ctx) == "" {
+		// dispatched by host, as <hostname>.<AppDomain>
+		label := strings.TrimSuffix(host, "."+app.proxy.appDomain)
+		return label != host && (label == strings.ToLower(app.manifest.hostname()) || label == strings.ToLower(app.name))
+	}
+	// apps on their own port or under /a/<app>/ are reached by address, and
+	// rebinding needs a domain name
+	return host == "localhost" || net.ParseIP(host) != nil
+}
+
+// Wraps handlers for the app's own data (config and storage), which act as the app
+// without a key. Apps served under /a/<app>/ all share the proxy's origin, so there
+// these requests must carry a key issued to the app (Authorization: Bearer <key>)
+func (app *appServer) withAppData(handle httprouter.Handle) httprouter.Handle {
+	return app.withApp(func(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		ctx := req.Context()
+		if key := bearerKey(req); key != "" || appPrefixFromContext(ctx) != "" {
+			perms, err := app.proxy.authorize(ctx, key)
+			if err == nil {
+				err = checkAppKey(ctx, perms)
+			}
+			if err != nil {
+				writeRPCError(rw, err)
+				return
+			}
+		}
+		handle(rw, req, ps)
+	})
+}
+
+// returns the name of the app a request came from, or "" if it was made directly
+// to the proxy server
+func appFromContext(ctx context.Context) string {
+	name, _ := ctx.Value(appContextKey{}).(string)
+	return name
+}
+
+// returns the path prefix the request was routed to its app by, or "" if it came in
+// on the app's own host or port
+func appPrefixFromContext(ctx context.Context) string {
+	prefix, _ := ctx.Value(appPrefixContextKey{}).(string)
+	return prefix
+}
+
+// gracefully shuts down the app's server and cancels its open subscriptions
+func (app *appServer) stop(ctx context.Context) error {
 	app.running = false
-	// TODO: wait for golang 1.8 graceful shutdown
+	close(app.done)
+	if app.server == nil {
+		return nil
+	}
+	return app.server.Shutdown(ctx)
 }
 
 func (app *appServer) index(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	defer req.Body.Close()
-	http.ServeFile(rw, req, app.root+"/index.html")
+	http.ServeFile(rw, req, app.root+"/"+app.manifest.entryPoint())
 }
 
 func (app *appServer) serveJS(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
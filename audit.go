@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// audit log that every proxied BOSSWAVE operation is written to. Nil if auditing is
+// disabled
+var auditor *auditLog
+
+// a single line in the audit log
+type auditEntry struct {
+	Time      time.Time
+	KeyID     string
+	App       string `json:",omitempty"`
+	VK        string
+	Procedure string
+	URI       string
+	PONum     string `json:",omitempty"`
+	// one of "ok", "denied", "limited" or "error"
+	Outcome string
+	Error   string `json:",omitempty"`
+	// time taken to complete the call (or to establish the subscription)
+	Latency time.Duration
+}
+
+// append-only JSON lines file. The file is rotated when it grows past maxSize, and
+// reopened on SIGHUP so it can also be rotated externally
+type auditLog struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	sync.Mutex
+}
+
+func openAuditLog(path string, maxSize int64) (*auditLog, error) {
+	a := &auditLog{
+		path:    path,
+		maxSize: maxSize,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			a.Lock()
+			a.file.Close()
+			if err := a.open(); err != nil {
+				log.Error(err)
+			}
+			a.Unlock()
+		}
+	}()
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Could not open audit log %s", a.path)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrapf(err, "Could not stat audit log %s", a.path)
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// moves the current file aside and starts a new one. Must be called with the lock held
+func (a *auditLog) rotate() error {
+	a.file.Close()
+	if err := os.Rename(a.path, rotatedName(a.path, time.Now())); err != nil {
+		log.Error(errors.Wrap(err, "Could not rotate audit log"))
+	}
+	return a.open()
+}
+
+// name for the audit log rotated at the given time. Names sort chronologically, and
+// an existing file is never reused, even if the log is rotated more than once at
+// the same instant
+func rotatedName(path string, t time.Time) string {
+	name := path + "." + t.UTC().Format("20060102T150405.000000000Z")
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(name); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%s-%03d", path, t.UTC().Format("20060102T150405.000000000Z"), i)
+	}
+}
+
+func (a *auditLog) write(entry auditEntry) {
+	if a == nil {
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Could not marshal audit entry"))
+		return
+	}
+	b = append(b, '\n')
+
+	a.Lock()
+	defer a.Unlock()
+	if a.maxSize > 0 && a.size+int64(len(b)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			log.Error(err)
+			return
+		}
+	}
+	n, err := a.file.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		log.Error(errors.Wrap(err, "Could not write audit entry"))
+	}
+}
+
+// records the outcome of an operation for the given key
+func (a *auditLog) record(ctx context.Context, perms Permissions, params BWRPCCall, start time.Time, outcome string, err error) {
+	if a == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:      start,
+		KeyID:     perms.ID,
+		App:       appFromContext(ctx),
+		VK:        perms.VK,
+		Procedure: params.Proc.String(),
+		URI:       getString("uri", params.Params),
+		PONum:     getString("ponum", params.Params),
+		Outcome:   outcome,
+		Latency:   time.Since(start),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	a.write(entry)
+}
+
+// returns the outcome to record for the error returned by an operation
+func auditOutcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	switch asRPCError(err).Code {
+	case codeForbidden:
+		return "denied"
+	case codeRateLimited:
+		return "limited"
+	}
+	return "error"
+}
+
+// returns true if the uri is prefix or lies under it. Compares whole URI elements,
+// so a/b is under a but not under a/bc
+func uriHasPrefix(uri, prefix string) bool {
+	uri, prefix = strings.Trim(uri, "/"), strings.Trim(prefix, "/")
+	return uri == prefix || strings.HasPrefix(uri, prefix+"/")
+}
+
+// prints the audit log entries matching the filters
+func searchAudit(c *cli.Context) error {
+	cfg := getConfig(c)
+
+	var (
+		keyID     = resolveKeyID(c.String("key"))
+		uriPrefix = strings.Trim(c.String("uri"), "/")
+		since     time.Time
+		until     time.Time
+		err       error
+	)
+	if s := c.String("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			return errors.Wrap(err, "Invalid --since")
+		}
+	}
+	if s := c.String("until"); s != "" {
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			return errors.Wrap(err, "Invalid --until")
+		}
+	}
+
+	// rotated files sort chronologically by name; the current file comes last
+	files, _ := filepath.Glob(cfg.AuditLog + ".*")
+	sort.Strings(files)
+	files = append(files, cfg.AuditLog)
+
+	for _, filename := range files {
+		f, err := os.Open(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var entry auditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				log.Warning(errors.Wrapf(err, "Skipping malformed entry in %s", filename))
+				continue
+			}
+			if keyID != "" && entry.KeyID != keyID {
+				continue
+			}
+			if uriPrefix != "" && !uriHasPrefix(entry.URI, uriPrefix) {
+				continue
+			}
+			if !since.IsZero() && entry.Time.Before(since) {
+				continue
+			}
+			if !until.IsZero() && entry.Time.After(until) {
+				continue
+			}
+			fmt.Println(scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return errors.Wrapf(err, "Could not read %s", filename)
+		}
+	}
+	return nil
+}
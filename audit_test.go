@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestURIHasPrefix(t *testing.T) {
+	for _, test := range []struct {
+		uri, prefix string
+		match       bool
+	}{
+		{"scratch.ns/demo", "scratch.ns/demo", true},
+		{"scratch.ns/demo/a/b", "scratch.ns/demo", true},
+		{"/scratch.ns/demo/a/", "scratch.ns/demo/", true},
+		{"scratch.ns/demo", "scratch.ns", true},
+		{"scratch.ns/demonstration", "scratch.ns/demo", false},
+		{"scratch.ns/dem", "scratch.ns/demo", false},
+		{"scratch.ns", "scratch.ns/demo", false},
+		{"other.ns/demo", "scratch.ns/demo", false},
+	} {
+		if got := uriHasPrefix(test.uri, test.prefix); got != test.match {
+			t.Errorf("uriHasPrefix(%q, %q) = %v, want %v", test.uri, test.prefix, got, test.match)
+		}
+	}
+}
+
+func TestAuditOutcome(t *testing.T) {
+	for _, test := range []struct {
+		err     error
+		outcome string
+	}{
+		{nil, "ok"},
+		{rpcErrorf(codeForbidden, "no"), "denied"},
+		{&limitError{msg: "slow down"}, "limited"},
+		{rpcErrorf(codeInvalidParams, "No method found matching UNKNOWN"), "error"},
+	} {
+		if got := auditOutcome(test.err); got != test.outcome {
+			t.Errorf("auditOutcome(%v) = %s, want %s", test.err, got, test.outcome)
+		}
+	}
+}
+
+// rotating many times in quick succession must not lose entries
+func TestAuditRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	a, err := openAuditLog(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.file.Close()
+	for i := 0; i < 50; i++ {
+		a.write(auditEntry{Time: time.Now(), KeyID: "key", Outcome: "ok"})
+	}
+
+	files, _ := filepath.Glob(path + ".*")
+	lines := 0
+	for _, filename := range append(files, path) {
+		f, err := os.Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for scanner := bufio.NewScanner(f); scanner.Scan(); {
+			lines++
+		}
+		f.Close()
+	}
+	if lines != 50 {
+		t.Errorf("found %d of 50 entries in %d files", lines, len(files)+1)
+	}
+
+	// names sort in the order the files were rotated, also within the same instant
+	now := time.Now()
+	var names []string
+	for i := 0; i < 12; i++ {
+		name := rotatedName(path, now)
+		if err := os.WriteFile(name, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if later := rotatedName(path, now.Add(time.Millisecond)); later <= names[len(names)-1] {
+		t.Errorf("%s sorts before %s", later, names[len(names)-1])
+	}
+	if !sort.StringsAreSorted(names) {
+		t.Errorf("rotated names out of order: %v", names)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// most calls accepted in one batch
+const maxBatchSize = 100
+
+// time allowed for a whole batch; calls that have not started by then fail with a
+// timeout, and calls still running are cancelled
+const batchTimeout = 30 * time.Second
+
+// result of one call of a batch; exactly one of Result and Error is set
+type batchResult struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *rpcError       `json:"error,omitempty"`
+}
+
+// returns true if the JSON body is an array
+func isBatch(body []byte) bool {
+	trimmed := bytes.TrimSpace(body)
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
+
+// returns the permissions of the last call of a batch whose key was authorized, or
+// empty permissions if there is none. The rate limit headers of a batch describe this key
+func lastAuthorized(perms []Permissions) Permissions {
+	for i := len(perms) - 1; i >= 0; i-- {
+		if perms[i].ID != "" {
+			return perms[i]
+		}
+	}
+	return Permissions{}
+}
+
+// calls fn for 0..n-1, running at most srv.batchParallelism calls at once
+func (srv *proxyServer) forEachParallel(n int, fn func(i int)) {
+	limit := srv.batchParallelism
+	if limit <= 0 {
+		limit = 1
+	}
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Runs a batch of calls (a JSON array of BWRPCCall) concurrently and responds with
+// an array holding the result or error of each call, in order. Each call has its own
+// timeout, which starts when the call does, and the batch as a whole must finish
+// within batchTimeout
+func (srv *proxyServer) doBatchCall(rw http.ResponseWriter, req *http.Request, body []byte) {
+	var calls []BWRPCCall
+	if err := json.Unmarshal(body, &calls); err != nil {
+		writeRPCError(rw, newRPCError(codeBadRequest, err))
+		return
+	}
+	if len(calls) == 0 || len(calls) > maxBatchSize {
+		writeRPCError(rw, rpcErrorf(codeBadRequest, "Batches must have between 1 and %d calls", maxBatchSize))
+		return
+	}
+
+	results := make([]batchResult, len(calls))
+	perms := make([]Permissions, len(calls))
+	batchctx, cancel := context.WithTimeout(req.Context(), batchTimeout)
+	defer cancel()
+	srv.forEachParallel(len(calls), func(i int) {
+		if err := batchctx.Err(); err != nil {
+			results[i].Error = asRPCError(err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(batchctx, 10*time.Second)
+		defer cancel()
+		result, p, err := srv.runCall(ctx, calls[i])
+		perms[i] = p
+		if err != nil {
+			log.Error(err)
+			results[i].Error = asRPCError(err)
+			return
+		}
+		if len(result) == 0 {
+			result = []byte("null")
+		}
+		results[i].Result = result
+	})
+	if last := lastAuthorized(perms); last.ID != "" {
+		srv.usage.setHeaders(rw, last)
+	}
+
+	if err := json.NewEncoder(rw).Encode(results); err != nil {
+		log.Error(errors.Wrap(err, "Could not write batch response"))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLastAuthorized(t *testing.T) {
+	perms := []Permissions{{ID: "a"}, {ID: "b"}, {}}
+	if got := lastAuthorized(perms); got.ID != "b" {
+		t.Errorf("got %q, want b", got.ID)
+	}
+	if got := lastAuthorized([]Permissions{{}, {}}); got.ID != "" {
+		t.Errorf("got %q for a batch without authorized keys", got.ID)
+	}
+}
+
+// calls that have not started when the batch runs out of time fail with a timeout
+func TestBatchDeadline(t *testing.T) {
+	srv, _, _ := newTestProxy(t)
+	key := "limited key"
+	srv.registry.addPermissions(key, Permissions{Query: QueryPermission{Allowed: true}, Limits: Limits{CallsPerSecond: 1, CallBurst: 5}})
+	body := `[{"proc": "query", "key": "` + key + `", "params": {"uri": "a/b"}}, {"proc": "query", "key": "wrong", "params": {"uri": "a/b"}}]`
+
+	for _, test := range []struct {
+		name    string
+		expired bool
+		codes   []string
+	}{
+		// there is no BOSSWAVE client behind the key, so the authorized call fails with a router error
+		{"in time", false, []string{codeRouter, codeUnauthorized}},
+		{"expired", true, []string{codeTimeout, codeTimeout}},
+	} {
+		req := httptest.NewRequest("POST", "http://localhost:2222/call", strings.NewReader(body))
+		if test.expired {
+			ctx, cancel := context.WithCancel(req.Context())
+			cancel()
+			req = req.WithContext(ctx)
+		}
+		rw := httptest.NewRecorder()
+		srv.doBatchCall(rw, req, []byte(body))
+
+		var results []batchResult
+		if err := json.Unmarshal(rw.Body.Bytes(), &results); err != nil {
+			t.Fatalf("%s: %v (%s)", test.name, err, rw.Body.String())
+		}
+		if len(results) != len(test.codes) {
+			t.Fatalf("%s: got %d results, want %d", test.name, len(results), len(test.codes))
+		}
+		for i, code := range test.codes {
+			if results[i].Error == nil || results[i].Error.Code != code {
+				t.Errorf("%s: call %d got error %+v, want %s", test.name, i, results[i].Error, code)
+			}
+		}
+		// the rate limit headers describe the authorized key, if any call got that far
+		if got := rw.Header().Get("X-RateLimit-Limit") != ""; got == test.expired {
+			t.Errorf("%s: rate limit headers %v", test.name, rw.Header())
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	bw2 "gopkg.in/immesys/bw2bind.v5"
@@ -21,6 +22,7 @@ const (
 	SUBSCRIBE
 	PUBLISH
 	QUERY
+	LIST
 )
 
 func (p *Procedure) UnmarshalJSON(b []byte) error {
@@ -28,19 +30,40 @@ func (p *Procedure) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &s); err != nil {
 		return err
 	}
-	s = strings.ToUpper(s)
 	log.Debug(s, "|", string(b))
-	switch s {
+	*p = parseProcedure(s)
+	return nil
+}
+
+// returns the procedure with the given name (in any case), or UNKNOWN
+func parseProcedure(name string) Procedure {
+	switch strings.ToUpper(name) {
 	case "SUBSCRIBE":
-		*p = SUBSCRIBE
+		return SUBSCRIBE
 	case "PUBLISH":
-		*p = PUBLISH
+		return PUBLISH
 	case "QUERY":
-		*p = QUERY
+		return QUERY
+	case "LIST":
+		return LIST
 	default:
-		*p = UNKNOWN
+		return UNKNOWN
+	}
+}
+
+func (p Procedure) String() string {
+	switch p {
+	case SUBSCRIBE:
+		return "SUBSCRIBE"
+	case PUBLISH:
+		return "PUBLISH"
+	case QUERY:
+		return "QUERY"
+	case LIST:
+		return "LIST"
+	default:
+		return "UNKNOWN"
 	}
-	return nil
 }
 
 type BWRPCCall struct {
@@ -52,9 +75,49 @@ type BWRPCCall struct {
 	Params map[string]interface{} `json:"params"`
 }
 
+// checks that the call names a known procedure and has the parameters it needs
+func validateCall(params BWRPCCall) error {
+	switch params.Proc {
+	case QUERY, SUBSCRIBE, LIST:
+	case PUBLISH:
+		if getString("ponum", params.Params) == "" {
+			return rpcErrorf(codeInvalidParams, "Missing ponum").with("param", "ponum")
+		}
+	default:
+		return rpcErrorf(codeInvalidParams, "No method found matching %v", params.Proc)
+	}
+	if getString("uri", params.Params) == "" {
+		return rpcErrorf(codeInvalidParams, "Missing uri").with("param", "uri")
+	}
+	return nil
+}
+
+// the error returned when the key does not allow the call
+func permissionError(params BWRPCCall) *rpcError {
+	uri := getString("uri", params.Params)
+	var err *rpcError
+	switch params.Proc {
+	case PUBLISH:
+		ponum := getString("ponum", params.Params)
+		err = rpcErrorf(codeForbidden, "Key has no permission to Publish PO %s to %s", ponum, uri).with("ponum", ponum)
+	case SUBSCRIBE:
+		err = rpcErrorf(codeForbidden, "Key has no permission to Subscribe to %s", uri)
+	case LIST:
+		err = rpcErrorf(codeForbidden, "Key has no permission to List %s", uri)
+	default:
+		err = rpcErrorf(codeForbidden, "Key has no permission to Query %s", uri)
+	}
+	return err.with("proc", params.Proc.String()).with("uri", uri)
+}
+
 // runs the RPC call and returns the json-serialized result and any error
 func doRPCCall(ctx context.Context, client *bw2.BW2Client, perms Permissions, params BWRPCCall) ([]byte, error) {
 	var result []byte
+	start := time.Now()
+	if err := validateCall(params); err != nil {
+		auditor.record(ctx, perms, params, start, auditOutcome(err), err)
+		return result, err
+	}
 	select {
 	case <-ctx.Done():
 		return result, ctx.Err()
@@ -62,16 +125,35 @@ func doRPCCall(ctx context.Context, client *bw2.BW2Client, perms Permissions, pa
 		switch params.Proc {
 		case QUERY:
 			if !checkQueryPermissions(perms, params) {
-				return result, errors.Errorf("Key has no permission to Query")
+				err := permissionError(params)
+				auditor.record(ctx, perms, params, start, "denied", err)
+				return result, err
 			}
-			return doQuery(ctx, client, params)
+			result, err := doQuery(ctx, client, perms, params)
+			auditor.record(ctx, perms, params, start, auditOutcome(err), err)
+			return result, err
 		case PUBLISH:
 			if !checkPublishPermissions(perms, params) {
-				return result, errors.Errorf("Key has no permission to Publish")
+				err := permissionError(params)
+				auditor.record(ctx, perms, params, start, "denied", err)
+				return result, err
+			}
+			result, err := doPublish(ctx, client, params)
+			auditor.record(ctx, perms, params, start, auditOutcome(err), err)
+			return result, err
+		case LIST:
+			if !checkListPermissions(perms, params) {
+				err := permissionError(params)
+				auditor.record(ctx, perms, params, start, "denied", err)
+				return result, err
 			}
-			return doPublish(ctx, client, params)
+			result, err := doList(ctx, client, perms, params)
+			auditor.record(ctx, perms, params, start, auditOutcome(err), err)
+			return result, err
 		default:
-			return result, errors.Errorf("No method found matching %v", params.Proc)
+			err := rpcErrorf(codeInvalidParams, "%v cannot be called on /call", params.Proc)
+			auditor.record(ctx, perms, params, start, auditOutcome(err), err)
+			return result, err
 		}
 	}
 }
@@ -81,19 +163,29 @@ func doRPCStream(ctx context.Context, client *bw2.BW2Client, perms Permissions,
 	var responses = make(chan []byte)
 	var errors = make(chan error, 1)
 	go func() {
+		if err := validateCall(params); err != nil {
+			auditor.record(ctx, perms, params, time.Now(), auditOutcome(err), err)
+			errors <- err
+			return
+		}
 		select {
 		case <-ctx.Done():
-			close(responses)
 			errors <- ctx.Err()
 			return
 		default:
 			switch params.Proc {
 			case SUBSCRIBE:
 				if !checkSubscribePermissions(perms, params) {
-					close(responses)
+					err := permissionError(params)
+					auditor.record(ctx, perms, params, time.Now(), "denied", err)
+					errors <- err
 					return
 				}
-				doSubscribe(ctx, responses, errors, client, params)
+				doSubscribe(ctx, responses, errors, client, perms, params)
+			default:
+				err := rpcErrorf(codeInvalidParams, "%v cannot be streamed", params.Proc)
+				auditor.record(ctx, perms, params, time.Now(), auditOutcome(err), err)
+				errors <- err
 			}
 		}
 	}()
@@ -101,7 +193,7 @@ func doRPCStream(ctx context.Context, client *bw2.BW2Client, perms Permissions,
 	return responses, errors
 }
 
-func doQuery(ctx context.Context, client *bw2.BW2Client, params BWRPCCall) ([]byte, error) {
+func doQuery(ctx context.Context, client *bw2.BW2Client, perms Permissions, params BWRPCCall) ([]byte, error) {
 	var results []interface{}
 
 	// params needed:
@@ -113,7 +205,7 @@ func doQuery(ctx context.Context, client *bw2.BW2Client, params BWRPCCall) ([]by
 		URI: uri,
 	})
 	if err != nil {
-		return []byte{}, errors.Wrap(err, "Could not query")
+		return []byte{}, newRPCError(codeRouter, errors.Wrap(err, "Could not query"))
 	}
 
 	for msg := range msgs {
@@ -126,6 +218,10 @@ func doQuery(ctx context.Context, client *bw2.BW2Client, params BWRPCCall) ([]by
 			if ponum != "" && !po.IsTypeDF(ponum) {
 				continue
 			}
+			// strip out POs the key is not allowed to receive
+			if !perms.Query.permitsPO(po.GetPODotNum()) {
+				continue
+			}
 			datum, err := po2iface(po)
 			if err != nil {
 				return []byte{}, errors.Wrap(err, "Could not retrieve iface from PO")
@@ -137,6 +233,35 @@ func doQuery(ctx context.Context, client *bw2.BW2Client, params BWRPCCall) ([]by
 	return datums2json(results)
 }
 
+func doList(ctx context.Context, client *bw2.BW2Client, perms Permissions, params BWRPCCall) ([]byte, error) {
+	// params needed:
+	// - uri
+	uri := getString("uri", params.Params)
+	children, err := client.List(&bw2.ListParams{
+		URI: uri,
+	})
+	if err != nil {
+		return []byte{}, newRPCError(codeRouter, errors.Wrap(err, "Could not list"))
+	}
+
+	uris := []string{}
+	for {
+		select {
+		case <-ctx.Done():
+			return []byte{}, ctx.Err()
+		case child, ok := <-children:
+			if !ok {
+				return json.Marshal(uris)
+			}
+			// leave out URIs the key is not allowed to list, e.g. denied subtrees
+			if !perms.List.permits(child) {
+				continue
+			}
+			uris = append(uris, child)
+		}
+	}
+}
+
 func doPublish(ctx context.Context, client *bw2.BW2Client, params BWRPCCall) ([]byte, error) {
 	// params needed:
 	// - uri
@@ -150,7 +275,7 @@ func doPublish(ctx context.Context, client *bw2.BW2Client, params BWRPCCall) ([]
 
 	po, err := iface2po(ponum, contents)
 	if err != nil {
-		return []byte{}, errors.Wrap(err, "Could not create PO from iface")
+		return []byte{}, newRPCError(codeInvalidParams, errors.Wrap(err, "Could not create PO from iface"))
 	}
 
 	err = client.Publish(&bw2.PublishParams{
@@ -158,47 +283,86 @@ func doPublish(ctx context.Context, client *bw2.BW2Client, params BWRPCCall) ([]
 		PayloadObjects: []bw2.PayloadObject{po},
 		Persist:        persist,
 	})
+	if err != nil {
+		return []byte{}, newRPCError(codeRouter, errors.Wrap(err, "Could not publish"))
+	}
 
-	return []byte{}, err
+	return []byte{}, nil
 }
 
-func doSubscribe(ctx context.Context, responses chan []byte, errchan chan error, client *bw2.BW2Client, params BWRPCCall) {
+// returns the number of payload bytes the publish call would send
+func publishSize(params BWRPCCall) (int64, error) {
+	po, err := iface2po(getString("ponum", params.Params), params.Params["contents"])
+	if err != nil {
+		return 0, newRPCError(codeInvalidParams, errors.Wrap(err, "Could not create PO from iface"))
+	}
+	if po == nil {
+		return 0, nil
+	}
+	return int64(len(po.GetContents())), nil
+}
+
+// Forwards the messages of a subscription to responses until ctx is cancelled or the
+// subscription fails. Sends exactly one error on errchan when it returns; the bw2
+// subscription is torn down either way
+func doSubscribe(ctx context.Context, responses chan []byte, errchan chan error, client *bw2.BW2Client, perms Permissions, params BWRPCCall) {
 	// params needed
 	// - uri
 	// - ponum (opt)
 	uri := getString("uri", params.Params)
 	ponum := getString("ponum", params.Params)
 
-	c, err := client.Subscribe(&bw2.SubscribeParams{
+	start := time.Now()
+	c, handle, err := client.SubscribeH(&bw2.SubscribeParams{
 		URI: uri,
 	})
 	log.Debug("START SUBSCRIBE", uri)
+	auditor.record(ctx, perms, params, start, auditOutcome(err), err)
 	if err != nil {
-		errchan <- errors.Wrap(err, "Could not subscribe")
+		errchan <- newRPCError(codeRouter, errors.Wrap(err, "Could not subscribe"))
 		return
 	}
+	defer func() {
+		if err := client.Unsubscribe(handle); err != nil {
+			log.Warning(errors.Wrapf(err, "Could not unsubscribe from %s", uri))
+		}
+		log.Debug("END SUBSCRIBE", uri)
+	}()
 
 	for {
 		select {
 		case <-ctx.Done():
-			close(c)
 			errchan <- ctx.Err()
 			return
-		case msg := <-c:
-			msg.Dump()
+		case msg, ok := <-c:
+			if !ok {
+				errchan <- rpcErrorf(codeRouter, "Subscription to %s was closed by the router", uri)
+				return
+			}
 			for _, po := range msg.POs {
 				if ponum != "" && !po.IsTypeDF(ponum) {
 					continue
 				}
+				// strip out POs the key is not allowed to receive
+				if !perms.Subscribe.permitsPO(po.GetPODotNum()) {
+					continue
+				}
 				datum, err := po2iface(po)
 				if err != nil {
-					errchan <- errors.Wrap(err, "Could not retrieve iface from PO")
+					// skip POs we cannot decode rather than ending the subscription
+					log.Warning(errors.Wrapf(err, "Could not retrieve iface from PO %s", po.GetPODotNum()))
+					continue
 				}
-
-				if res, err := datum2json(datum); err != nil {
-					errchan <- errors.Wrap(err, "Could not marshal json")
-				} else {
-					responses <- res
+				res, err := datum2json(datum)
+				if err != nil {
+					log.Warning(errors.Wrap(err, "Could not marshal json"))
+					continue
+				}
+				select {
+				case responses <- res:
+				case <-ctx.Done():
+					errchan <- ctx.Err()
+					return
 				}
 			}
 		}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Port           string
+	ListenAddress  string
+	StaticPath     string
+	AppPath        string
+	PortRangeStart int
+	// number of ports (starting at PortRangeStart) available to app servers
+	PortRangeSize int
+	UseIPv6       bool
+	BOSSWAVEAgent string
+	// if true, all apps are served on Port, dispatched by host (<app>.<AppDomain>)
+	// or by path prefix (/a/<app>/), instead of each getting its own port
+	SharedPort bool
+	AppDomain  string
+	// path of the audit log; auditing is disabled if empty
+	AuditLog string
+	// size in bytes at which the audit log is rotated; never rotated if 0
+	AuditLogMaxSize int64
+	// address and port of the admin server
+	AdminListenAddress string
+	AdminPort          string
+	// credential required for the admin server; generated at startup if empty
+	AdminCredential string
+	// bytes each app may keep in its storage; unlimited if 0
+	StorageQuota int64
+	// calls of a batch that are run at once
+	BatchParallelism int
+}
+
+// default configuration; anything not set in the config file, the environment
+// or on the command line falls back to these values
+func defaultConfig() *Config {
+	return &Config{
+		Port:               "2222",
+		ListenAddress:      "127.0.0.1",
+		StaticPath:         ".",
+		AppPath:            "./apps",
+		PortRangeStart:     8000,
+		PortRangeSize:      100,
+		UseIPv6:            false,
+		BOSSWAVEAgent:      "",
+		SharedPort:         false,
+		AppDomain:          "bw.local",
+		AuditLog:           "./audit.log",
+		AuditLogMaxSize:    100 * 1024 * 1024,
+		AdminListenAddress: "127.0.0.1",
+		AdminPort:          "2223",
+		AdminCredential:    "",
+		StorageQuota:       10 * 1024 * 1024,
+		BatchParallelism:   8,
+	}
+}
+
+// global flags; every field in Config can be overridden by a flag or its
+// environment variable
+var configFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config, c",
+		Usage:  "Path to TOML (or YAML, if named .yaml/.yml) configuration file",
+		EnvVar: "BWPROXY_CONFIG",
+	},
+	cli.StringFlag{
+		Name:   "port",
+		Usage:  "Port for the proxy server",
+		EnvVar: "BWPROXY_PORT",
+	},
+	cli.StringFlag{
+		Name:   "listen-address",
+		Usage:  "Address the proxy server and apps listen on",
+		EnvVar: "BWPROXY_LISTEN_ADDRESS",
+	},
+	cli.StringFlag{
+		Name:   "static-path",
+		Usage:  "Directory containing the static/ folder and the registry database",
+		EnvVar: "BWPROXY_STATIC_PATH",
+	},
+	cli.StringFlag{
+		Name:   "app-path",
+		Usage:  "Directory where applications are installed",
+		EnvVar: "BWPROXY_APP_PATH",
+	},
+	cli.IntFlag{
+		Name:   "port-range-start",
+		Usage:  "First port handed out to application servers",
+		EnvVar: "BWPROXY_PORT_RANGE_START",
+	},
+	cli.IntFlag{
+		Name:   "port-range-size",
+		Usage:  "Number of ports handed out to application servers",
+		EnvVar: "BWPROXY_PORT_RANGE_SIZE",
+	},
+	cli.BoolFlag{
+		Name:   "ipv6",
+		Usage:  "Listen on IPv6",
+		EnvVar: "BWPROXY_IPV6",
+	},
+	cli.StringFlag{
+		Name:   "agent",
+		Usage:  "Address of the BOSSWAVE agent",
+		EnvVar: "BWPROXY_AGENT,BW2_AGENT",
+	},
+	cli.BoolFlag{
+		Name:   "shared-port",
+		Usage:  "Serve all apps on the proxy port, dispatched by host or path prefix",
+		EnvVar: "BWPROXY_SHARED_PORT",
+	},
+	cli.StringFlag{
+		Name:   "app-domain",
+		Usage:  "Domain apps are served under in shared port mode (e.g. demo.bw.local)",
+		EnvVar: "BWPROXY_APP_DOMAIN",
+	},
+	cli.StringFlag{
+		Name:   "audit-log",
+		Usage:  "Path of the audit log (empty to disable)",
+		EnvVar: "BWPROXY_AUDIT_LOG",
+	},
+	cli.Int64Flag{
+		Name:   "audit-log-max-size",
+		Usage:  "Size in bytes at which the audit log is rotated (0 to never rotate)",
+		EnvVar: "BWPROXY_AUDIT_LOG_MAX_SIZE",
+	},
+	cli.StringFlag{
+		Name:   "admin-listen-address",
+		Usage:  "Address the admin server listens on",
+		EnvVar: "BWPROXY_ADMIN_LISTEN_ADDRESS",
+	},
+	cli.StringFlag{
+		Name:   "admin-port",
+		Usage:  "Port for the admin server",
+		EnvVar: "BWPROXY_ADMIN_PORT",
+	},
+	cli.StringFlag{
+		Name:   "admin-credential",
+		Usage:  "Credential required by the admin server",
+		EnvVar: "BWPROXY_ADMIN_CREDENTIAL",
+	},
+	cli.Int64Flag{
+		Name:   "storage-quota",
+		Usage:  "Bytes each app may keep in its storage (0 for unlimited)",
+		EnvVar: "BWPROXY_STORAGE_QUOTA",
+	},
+	cli.IntFlag{
+		Name:   "batch-parallelism",
+		Usage:  "Number of calls of a batch that are run at once",
+		EnvVar: "BWPROXY_BATCH_PARALLELISM",
+	},
+}
+
+// builds the effective configuration: defaults, then the config file (if any),
+// then environment variables and command line flags
+func loadConfig(c *cli.Context) (*Config, error) {
+	cfg := defaultConfig()
+
+	if filename := c.GlobalString("config"); filename != "" {
+		if err := decodeConfigFile(filename, cfg); err != nil {
+			return nil, errors.Wrapf(err, "Could not load config file %s", filename)
+		}
+	}
+
+	if c.GlobalIsSet("port") {
+		cfg.Port = c.GlobalString("port")
+	}
+	if c.GlobalIsSet("listen-address") {
+		cfg.ListenAddress = c.GlobalString("listen-address")
+	}
+	if c.GlobalIsSet("static-path") {
+		cfg.StaticPath = c.GlobalString("static-path")
+	}
+	if c.GlobalIsSet("app-path") {
+		cfg.AppPath = c.GlobalString("app-path")
+	}
+	if c.GlobalIsSet("port-range-start") {
+		cfg.PortRangeStart = c.GlobalInt("port-range-start")
+	}
+	if c.GlobalIsSet("port-range-size") {
+		cfg.PortRangeSize = c.GlobalInt("port-range-size")
+	}
+	if c.GlobalIsSet("ipv6") {
+		cfg.UseIPv6 = c.GlobalBool("ipv6")
+	}
+	if c.GlobalIsSet("agent") {
+		cfg.BOSSWAVEAgent = c.GlobalString("agent")
+	}
+	if c.GlobalIsSet("shared-port") {
+		cfg.SharedPort = c.GlobalBool("shared-port")
+	}
+	if c.GlobalIsSet("app-domain") {
+		cfg.AppDomain = c.GlobalString("app-domain")
+	}
+	if c.GlobalIsSet("audit-log") {
+		cfg.AuditLog = c.GlobalString("audit-log")
+	}
+	if c.GlobalIsSet("audit-log-max-size") {
+		cfg.AuditLogMaxSize = c.GlobalInt64("audit-log-max-size")
+	}
+	if c.GlobalIsSet("admin-listen-address") {
+		cfg.AdminListenAddress = c.GlobalString("admin-listen-address")
+	}
+	if c.GlobalIsSet("admin-port") {
+		cfg.AdminPort = c.GlobalString("admin-port")
+	}
+	if c.GlobalIsSet("admin-credential") {
+		cfg.AdminCredential = c.GlobalString("admin-credential")
+	}
+	if c.GlobalIsSet("storage-quota") {
+		cfg.StorageQuota = c.GlobalInt64("storage-quota")
+	}
+	if c.GlobalIsSet("batch-parallelism") {
+		cfg.BatchParallelism = c.GlobalInt("batch-parallelism")
+	}
+
+	return cfg, nil
+}
+
+// decodes a TOML config file, or a YAML one if it is named .yaml or .yml.
+// Keys are the Config field names in both formats
+func decodeConfigFile(filename string, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		var values map[string]interface{}
+		if err := yaml.Unmarshal(contents, &values); err != nil {
+			return err
+		}
+		// go through JSON so keys match the field names case-insensitively, as they do in TOML
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(encoded, cfg)
+	default:
+		_, err := toml.DecodeFile(filename, cfg)
+		return err
+	}
+}
+
+// checks that the configured paths exist and the ports and addresses are usable
+func (cfg *Config) validate() error {
+	port, err := strconv.Atoi(cfg.Port)
+	if err != nil || port <= 0 || port > 65535 {
+		return errors.Errorf("Invalid Port %q", cfg.Port)
+	}
+	if cfg.PortRangeStart <= 0 || cfg.PortRangeStart > 65535 {
+		return errors.Errorf("Invalid PortRangeStart %d", cfg.PortRangeStart)
+	}
+	if cfg.PortRangeSize <= 0 || cfg.PortRangeStart+cfg.PortRangeSize-1 > 65535 {
+		return errors.Errorf("Invalid PortRangeSize %d", cfg.PortRangeSize)
+	}
+	if err := cfg.checkAddress(cfg.ListenAddress); err != nil {
+		return errors.Wrap(err, "Invalid ListenAddress")
+	}
+	adminport, err := strconv.Atoi(cfg.AdminPort)
+	if err != nil || adminport <= 0 || adminport > 65535 {
+		return errors.Errorf("Invalid AdminPort %q", cfg.AdminPort)
+	}
+	if err := cfg.checkAddress(cfg.AdminListenAddress); err != nil {
+		return errors.Wrap(err, "Invalid AdminListenAddress")
+	}
+	if adminport == port {
+		return errors.New("AdminPort must be different from Port")
+	}
+	if err := checkDir(cfg.StaticPath + "/static"); err != nil {
+		return errors.Wrap(err, "Invalid StaticPath")
+	}
+	if err := checkDir(cfg.AppPath); err != nil {
+		return errors.Wrap(err, "Invalid AppPath")
+	}
+	if cfg.AuditLog != "" {
+		if err := checkDir(filepath.Dir(cfg.AuditLog)); err != nil {
+			return errors.Wrap(err, "Invalid AuditLog")
+		}
+	}
+	if cfg.AuditLogMaxSize < 0 {
+		return errors.Errorf("Invalid AuditLogMaxSize %d", cfg.AuditLogMaxSize)
+	}
+	if cfg.StorageQuota < 0 {
+		return errors.Errorf("Invalid StorageQuota %d", cfg.StorageQuota)
+	}
+	if cfg.BatchParallelism <= 0 {
+		return errors.Errorf("Invalid BatchParallelism %d", cfg.BatchParallelism)
+	}
+	return nil
+}
+
+func (cfg *Config) checkAddress(address string) error {
+	if ip := net.ParseIP(address); ip == nil {
+		return errors.Errorf("%q is not an IP address", address)
+	} else if cfg.UseIPv6 && ip.To4() != nil {
+		return errors.Errorf("%q is not an IPv6 address", address)
+	} else if !cfg.UseIPv6 && ip.To4() == nil {
+		return errors.Errorf("%q is not an IPv4 address", address)
+	}
+	return nil
+}
+
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
+
+// loads and validates the configuration for a command
+func getConfig(c *cli.Context) *Config {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatal(errors.Wrap(err, "Invalid configuration"))
+	}
+	return cfg
+}
+
+func printConfig(c *cli.Context) error {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return err
+	}
+	if err := cfg.validate(); err != nil {
+		log.Warning(err)
+	}
+	return toml.NewEncoder(os.Stdout).Encode(cfg)
+}
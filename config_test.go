@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	want := defaultConfig()
+	want.Port = "3333"
+	want.PortRangeSize = 20
+	want.SharedPort = true
+	want.AuditLogMaxSize = 1024
+
+	for _, test := range []struct {
+		name     string
+		contents string
+	}{
+		{"bwproxy.toml", "Port = \"3333\"\nPortRangeSize = 20\nSharedPort = true\nAuditLogMaxSize = 1024\n"},
+		{"bwproxy.yaml", "Port: \"3333\"\nPortRangeSize: 20\nSharedPort: true\nAuditLogMaxSize: 1024\n"},
+		{"bwproxy.YML", "port: \"3333\"\nportrangesize: 20\nsharedport: true\nauditlogmaxsize: 1024\n"},
+	} {
+		filename := filepath.Join(dir, test.name)
+		if err := os.WriteFile(filename, []byte(test.contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := defaultConfig()
+		if err := decodeConfigFile(filename, cfg); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, cfg, want)
+		}
+	}
+
+	for _, test := range []struct {
+		name     string
+		contents string
+	}{
+		{"bad.toml", "Port = 3333\n"},
+		{"bad.yaml", "Port: [3333]\n"},
+		{"bad.yml", "- not a mapping\n"},
+	} {
+		filename := filepath.Join(dir, test.name)
+		os.WriteFile(filename, []byte(test.contents), 0644)
+		if err := decodeConfigFile(filename, defaultConfig()); err == nil {
+			t.Errorf("%s: decoded %q", test.name, test.contents)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Subscriptions over Server-Sent Events, for clients that cannot use websockets.
+// Each subscription is an event stream that keeps running for eventLinger after its
+// last client disconnects, buffering up to eventBufferSize messages, so a client
+// reconnecting with Last-Event-ID misses nothing in between
+const (
+	eventLinger     = 30 * time.Second
+	eventBufferSize = 100
+	// interval of comment lines keeping idle connections (and proxies) open
+	eventHeartbeat = 15 * time.Second
+	// how long a stream token can be used for
+	eventTokenTTL = 30 * time.Second
+)
+
+type sseEvent struct {
+	seq  uint64
+	data []byte
+}
+
+type eventStream struct {
+	id string
+	// what the stream was opened for; a reconnecting client must match
+	keyID, app, uri, ponum string
+	cancel                 context.CancelFunc
+
+	sync.Mutex
+	// the most recent events, oldest first
+	events []sseEvent
+	seq    uint64
+	// set when the subscription has ended
+	err error
+	// notified of new events
+	listeners map[chan struct{}]struct{}
+	linger    *time.Timer
+}
+
+// EventSource cannot set headers, so instead of putting the key in the URL, clients
+// exchange it for a token that opens one stream
+type eventToken struct {
+	key     string
+	app     string
+	expires time.Time
+}
+
+// the event streams of the proxy, by id
+type eventHub struct {
+	streams map[string]*eventStream
+	// unused stream tokens
+	tokens map[string]eventToken
+	sync.Mutex
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		streams: make(map[string]*eventStream),
+		tokens:  make(map[string]eventToken),
+	}
+}
+
+// returns a new token standing for the key on requests through the app
+func (hub *eventHub) issueToken(key, app string) (string, error) {
+	tokenbytes := make([]byte, 16)
+	if _, err := rand.Read(tokenbytes); err != nil {
+		return "", errors.Wrap(err, "Could not generate stream token")
+	}
+	token := hex.EncodeToString(tokenbytes)
+	now := time.Now()
+
+	hub.Lock()
+	defer hub.Unlock()
+	for t, issued := range hub.tokens {
+		if now.After(issued.expires) {
+			delete(hub.tokens, t)
+		}
+	}
+	hub.tokens[token] = eventToken{key: key, app: app, expires: now.Add(eventTokenTTL)}
+	return token, nil
+}
+
+// returns the key the token was issued for and invalidates the token. Tokens only
+// work once, before they expire, and through the app they were issued by
+func (hub *eventHub) takeToken(token, app string) (string, bool) {
+	hub.Lock()
+	defer hub.Unlock()
+	issued, found := hub.tokens[token]
+	delete(hub.tokens, token)
+	if !found || issued.app != app || time.Now().After(issued.expires) {
+		return "", false
+	}
+	return issued.key, true
+}
+
+// Last-Event-ID is <stream id>-<sequence number>
+func parseEventID(lastEventID string) (string, uint64) {
+	idx := strings.LastIndex(lastEventID, "-")
+	if idx < 0 {
+		return "", 0
+	}
+	seq, err := strconv.ParseUint(lastEventID[idx+1:], 10, 64)
+	if err != nil {
+		return "", 0
+	}
+	return lastEventID[:idx], seq
+}
+
+// returns the stream with the given id if it was opened for the same subscription
+func (hub *eventHub) find(id, keyID, app, uri, ponum string) *eventStream {
+	hub.Lock()
+	defer hub.Unlock()
+	stream, found := hub.streams[id]
+	if !found || stream.keyID != keyID || stream.app != app || stream.uri != uri || stream.ponum != ponum {
+		return nil
+	}
+	return stream
+}
+
+func (hub *eventHub) remove(stream *eventStream) {
+	hub.Lock()
+	delete(hub.streams, stream.id)
+	hub.Unlock()
+}
+
+// starts a subscription that appends to a new event stream
+func (srv *proxyServer) openEventStream(app string, client *bw2.BW2Client, perms Permissions, call BWRPCCall) (*eventStream, error) {
+	if err := srv.usage.openSubscription(perms); err != nil {
+		return nil, err
+	}
+	idbytes := make([]byte, 8)
+	if _, err := rand.Read(idbytes); err != nil {
+		srv.usage.closeSubscription(perms)
+		return nil, errors.Wrap(err, "Could not generate stream id")
+	}
+	ctx, cancel := srv.eventStreamContext(app)
+	stream := &eventStream{
+		id:        hex.EncodeToString(idbytes),
+		keyID:     perms.ID,
+		app:       app,
+		uri:       getString("uri", call.Params),
+		ponum:     getString("ponum", call.Params),
+		cancel:    cancel,
+		listeners: make(map[chan struct{}]struct{}),
+	}
+	srv.events.Lock()
+	srv.events.streams[stream.id] = stream
+	srv.events.Unlock()
+
+	go func() {
+		defer srv.usage.closeSubscription(perms)
+		defer srv.events.remove(stream)
+		stream.finish(srv.pumpEvents(ctx, stream, client, perms, call))
+	}()
+	return stream, nil
+}
+
+// returns the context for a stream opened through the app (or directly, if app is
+// ""). The stream outlives the request that opened it, but is still made as the app,
+// and ends when the app is stopped or uninstalled
+func (srv *proxyServer) eventStreamContext(app string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), appContextKey{}, app))
+	if app == "" {
+		return ctx, cancel
+	}
+	srv.appsLock.Lock()
+	running, found := srv.runningApps[app]
+	srv.appsLock.Unlock()
+	if !found {
+		// stopped while the request was being handled
+		cancel()
+		return ctx, cancel
+	}
+	go func() {
+		select {
+		case <-running.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// appends the results of the subscription to the stream until it is cancelled or fails
+func (srv *proxyServer) pumpEvents(ctx context.Context, stream *eventStream, client *bw2.BW2Client, perms Permissions, call BWRPCCall) error {
+	// close the subscription when the key stops being valid
+	var expired <-chan time.Time
+	if until := perms.validUntil(time.Now()); !until.IsZero() {
+		expiry := time.NewTimer(time.Until(until))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
+	respchan, errchan := doRPCStream(ctx, client, perms, call)
+	for {
+		select {
+		case <-expired:
+			now := time.Now()
+			if err := perms.checkValidAt(now); err != nil {
+				log.Warning("Closing subscription:", err)
+				return newRPCError(codeUnauthorized, err)
+			}
+			// moved into another window
+			if until := perms.validUntil(now); !until.IsZero() {
+				expired = time.After(time.Until(until))
+			} else {
+				expired = nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errchan:
+			return err
+		case resp := <-respchan:
+			stream.append(resp)
+		}
+	}
+}
+
+func (stream *eventStream) append(data []byte) {
+	stream.Lock()
+	defer stream.Unlock()
+	stream.seq++
+	stream.events = append(stream.events, sseEvent{seq: stream.seq, data: data})
+	if len(stream.events) > eventBufferSize {
+		stream.events = stream.events[len(stream.events)-eventBufferSize:]
+	}
+	stream.notify()
+}
+
+func (stream *eventStream) finish(err error) {
+	stream.Lock()
+	defer stream.Unlock()
+	if err == nil {
+		err = errors.New("Subscription ended")
+	}
+	stream.err = err
+	stream.notify()
+}
+
+func (stream *eventStream) notify() {
+	for listener := range stream.listeners {
+		select {
+		case listener <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// registers a client of the stream; the stream stops lingering
+func (stream *eventStream) attach() chan struct{} {
+	stream.Lock()
+	defer stream.Unlock()
+	if stream.linger != nil {
+		stream.linger.Stop()
+		stream.linger = nil
+	}
+	listener := make(chan struct{}, 1)
+	stream.listeners[listener] = struct{}{}
+	return listener
+}
+
+// unregisters a client; the subscription is closed if no client reattaches in time
+func (stream *eventStream) detach(listener chan struct{}) {
+	stream.Lock()
+	defer stream.Unlock()
+	delete(stream.listeners, listener)
+	if len(stream.listeners) == 0 && stream.linger == nil {
+		stream.linger = time.AfterFunc(eventLinger, stream.cancel)
+	}
+}
+
+// returns the buffered events after seq and whether the subscription has ended
+func (stream *eventStream) since(seq uint64) ([]sseEvent, error) {
+	stream.Lock()
+	defer stream.Unlock()
+	var events []sseEvent
+	for _, event := range stream.events {
+		if event.seq > seq {
+			events = append(events, event)
+		}
+	}
+	return events, stream.err
+}
+
+// Issues a stream token for the key in the body ({"key": ...}) or the Authorization
+// header. The token is passed to GET /events as the token query parameter
+func (srv *proxyServer) issueEventToken(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	ctx := req.Context()
+	rw.Header().Set("Content-Type", "application/json")
+
+	var call BWRPCCall
+	if err := json.NewDecoder(req.Body).Decode(&call); err != nil && err != io.EOF {
+		writeRPCError(rw, newRPCError(codeBadRequest, err))
+		return
+	}
+	if call.Key == "" {
+		call.Key = bearerKey(req)
+	}
+	permissions, err := srv.authorize(ctx, call.Key)
+	if err != nil {
+		writeRPCError(rw, err)
+		return
+	}
+	if err := checkAppKey(ctx, permissions); err != nil {
+		writeRPCError(rw, err)
+		return
+	}
+	token, err := srv.events.issueToken(call.Key, appFromContext(ctx))
+	if err != nil {
+		writeRPCError(rw, err)
+		return
+	}
+	json.NewEncoder(rw).Encode(map[string]string{"token": token})
+}
+
+// Subscribes with the uri and ponum query parameters and streams each message as an
+// event. EventSource cannot set headers and keys must not appear in URLs, so the key
+// is given as a stream token (the token query parameter, from POST /events); requests
+// through an app's own host or port may leave it out. Clients that cannot send
+// Last-Event-ID may pass it as the lastEventId query parameter
+func (srv *proxyServer) doEvents(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	ctx := req.Context()
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		rw.WriteHeader(500)
+		rw.Write([]byte("Streaming is not supported"))
+		return
+	}
+
+	query := req.URL.Query()
+	var key string
+	if token := query.Get("token"); token != "" {
+		var valid bool
+		if key, valid = srv.events.takeToken(token, appFromContext(ctx)); !valid {
+			writeRPCError(rw, rpcErrorf(codeUnauthorized, "Unknown or expired stream token"))
+			return
+		}
+	}
+	call := BWRPCCall{
+		Key:  key,
+		Proc: SUBSCRIBE,
+		Params: map[string]interface{}{
+			"uri":   query.Get("uri"),
+			"ponum": query.Get("ponum"),
+		},
+	}
+
+	permissions, err := srv.authorize(ctx, call.Key)
+	if err != nil {
+		writeRPCError(rw, err)
+		return
+	}
+	if err := checkAppKey(ctx, permissions); err != nil {
+		writeRPCError(rw, err)
+		return
+	}
+	if err := validateCall(call); err != nil {
+		auditor.record(ctx, permissions, call, time.Now(), auditOutcome(err), err)
+		writeRPCError(rw, err)
+		return
+	}
+	if !checkSubscribePermissions(permissions, call) {
+		err := permissionError(call)
+		auditor.record(ctx, permissions, call, time.Now(), "denied", err)
+		writeRPCError(rw, err)
+		return
+	}
+	client := srv.registry.getClientForVK(permissions.VK)
+	if client == nil {
+		writeRPCError(rw, noClientError())
+		return
+	}
+	if err := srv.usage.takeCall(permissions); err != nil {
+		auditor.record(ctx, permissions, call, time.Now(), auditOutcome(err), err)
+		writeRPCError(rw, err)
+		return
+	}
+
+	// resume the stream the client was reading, if it is still running
+	app := appFromContext(ctx)
+	uri, ponum := getString("uri", call.Params), getString("ponum", call.Params)
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = query.Get("lastEventId")
+	}
+	streamID, seq := parseEventID(lastEventID)
+	stream := srv.events.find(streamID, permissions.ID, app, uri, ponum)
+	if stream == nil {
+		seq = 0
+		if stream, err = srv.openEventStream(app, client, permissions, call); err != nil {
+			auditor.record(ctx, permissions, call, time.Now(), auditOutcome(err), err)
+			writeRPCError(rw, err)
+			return
+		}
+	}
+	listener := stream.attach()
+	defer stream.detach(listener)
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	// don't let nginx and friends buffer the stream
+	rw.Header().Set("X-Accel-Buffering", "no")
+	rw.WriteHeader(200)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		events, err := stream.since(seq)
+		for _, event := range events {
+			fmt.Fprintf(rw, "id: %s-%d\n", stream.id, event.seq)
+			for _, line := range strings.Split(string(event.data), "\n") {
+				fmt.Fprintf(rw, "data: %s\n", line)
+			}
+			fmt.Fprint(rw, "\n")
+			seq = event.seq
+		}
+		if err != nil {
+			failure, _ := json.Marshal(asRPCError(err))
+			fmt.Fprintf(rw, "event: failure\ndata: %s\n\n", failure)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-listener:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(rw, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streams opened through an app end when the app is stopped, not when they stop lingering
+func TestEventStreamEndsWithApp(t *testing.T) {
+	srv, _, _ := newTestProxy(t)
+
+	direct, cancel := srv.eventStreamContext("")
+	defer cancel()
+	ctxA, cancelA := srv.eventStreamContext("a")
+	defer cancelA()
+	ctxB, cancelB := srv.eventStreamContext("b")
+	defer cancelB()
+	if appFromContext(ctxA) != "a" {
+		t.Errorf("stream context is made as %q", appFromContext(ctxA))
+	}
+
+	srv.runningApps["a"].stop(context.Background())
+	select {
+	case <-ctxA.Done():
+	case <-time.After(time.Second):
+		t.Error("stream of a stopped app is still running")
+	}
+	if direct.Err() != nil || ctxB.Err() != nil {
+		t.Error("stopping an app ended other streams")
+	}
+
+	delete(srv.runningApps, "a")
+	if ctx, cancel := srv.eventStreamContext("a"); ctx.Err() == nil {
+		cancel()
+		t.Error("opened a stream for an app that is not running")
+	}
+}
+
+func TestEventTokens(t *testing.T) {
+	hub := newEventHub()
+	for _, test := range []struct {
+		name string
+		// app the token is issued through and used through
+		issuedBy, usedBy string
+		expired          bool
+		valid            bool
+	}{
+		{"direct", "", "", false, true},
+		{"same app", "a", "a", false, true},
+		{"other app", "a", "b", false, false},
+		{"app token used directly", "a", "", false, false},
+		{"expired", "", "", true, false},
+	} {
+		token, err := hub.issueToken("the key", test.issuedBy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.expired {
+			issued := hub.tokens[token]
+			issued.expires = time.Now().Add(-time.Second)
+			hub.tokens[token] = issued
+		}
+		key, valid := hub.takeToken(token, test.usedBy)
+		if valid != test.valid || (valid && key != "the key") {
+			t.Errorf("%s: got %q, %v; want valid=%v", test.name, key, valid, test.valid)
+		}
+		// tokens only work once, even if they were refused
+		if _, valid := hub.takeToken(token, test.usedBy); valid {
+			t.Errorf("%s: token worked twice", test.name)
+		}
+	}
+
+	// expired tokens are dropped when new ones are issued
+	hub.tokens["stale"] = eventToken{key: "old key", expires: time.Now().Add(-time.Minute)}
+	hub.issueToken("the key", "")
+	if _, found := hub.tokens["stale"]; found {
+		t.Error("expired token was kept")
+	}
+}
+
+// keys are exchanged for tokens, and never accepted in the URL
+func TestEventsRequest(t *testing.T) {
+	srv, keyA, _ := newTestProxy(t)
+
+	rw := httptest.NewRecorder()
+	srv.issueEventToken(rw, httptest.NewRequest("POST", "http://localhost:2222/events", strings.NewReader(`{"key": "`+keyA+`"}`)), nil)
+	var issued struct{ Token string }
+	if err := json.Unmarshal(rw.Body.Bytes(), &issued); err != nil || rw.Code != 200 || issued.Token == "" {
+		t.Fatalf("got %d %s", rw.Code, rw.Body)
+	}
+	rw = httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "http://localhost:2222/events", nil)
+	req.Header.Set("Authorization", "Bearer wrong key")
+	srv.issueEventToken(rw, req, nil)
+	if rw.Code != 401 {
+		t.Errorf("token for a wrong key: got %d %s", rw.Code, rw.Body)
+	}
+
+	for _, test := range []struct {
+		name  string
+		query string
+	}{
+		{"key in the url", "key=" + keyA},
+		{"unknown token", "token=0123456789abcdef"},
+		{"reused token", "token=" + issued.Token},
+	} {
+		if test.name == "reused token" {
+			srv.events.takeToken(issued.Token, "")
+		}
+		rw := httptest.NewRecorder()
+		srv.doEvents(rw, httptest.NewRequest("GET", "http://localhost:2222/events?uri=scratch.ns/a&"+test.query, nil), nil)
+		if rw.Code != 401 {
+			t.Errorf("%s: got %d %s, want 401", test.name, rw.Code, rw.Body)
+		}
+	}
+}
+
+// a reconnecting client resumes the stream it was reading after the last event it saw
+func TestEventStreamResume(t *testing.T) {
+	hub := newEventHub()
+	stream := &eventStream{id: "0123abcd", keyID: "key", app: "a", uri: "scratch.ns/a", listeners: make(map[chan struct{}]struct{})}
+	hub.streams[stream.id] = stream
+
+	for _, test := range []struct {
+		lastEventID string
+		id          string
+		seq         uint64
+	}{
+		{"0123abcd-5", "0123abcd", 5},
+		{"with-dashes-12", "with-dashes", 12},
+		{"0123abcd", "", 0},
+		{"0123abcd-x", "", 0},
+		{"", "", 0},
+	} {
+		if id, seq := parseEventID(test.lastEventID); id != test.id || seq != test.seq {
+			t.Errorf("parseEventID(%q) = %q, %d; want %q, %d", test.lastEventID, id, seq, test.id, test.seq)
+		}
+	}
+
+	if hub.find("0123abcd", "key", "a", "scratch.ns/a", "") != stream {
+		t.Error("stream not found")
+	}
+	// only the same subscription can be resumed
+	for _, args := range [][]string{
+		{"0123abcd", "other key", "a", "scratch.ns/a", ""},
+		{"0123abcd", "key", "b", "scratch.ns/a", ""},
+		{"0123abcd", "key", "a", "scratch.ns/b", ""},
+		{"0123abcd", "key", "a", "scratch.ns/a", "2.0.0.0"},
+		{"unknown", "key", "a", "scratch.ns/a", ""},
+	} {
+		if hub.find(args[0], args[1], args[2], args[3], args[4]) != nil {
+			t.Errorf("resumed stream with %v", args)
+		}
+	}
+
+	listener := stream.attach()
+	for i := 1; i <= eventBufferSize+10; i++ {
+		stream.append([]byte(fmt.Sprint(i)))
+	}
+	select {
+	case <-listener:
+	default:
+		t.Error("listener was not notified")
+	}
+	events, err := stream.since(eventBufferSize + 5)
+	if err != nil || len(events) != 5 || events[0].seq != eventBufferSize+6 || string(events[4].data) != fmt.Sprint(eventBufferSize+10) {
+		t.Errorf("got %v, %v", events, err)
+	}
+	// older events are no longer buffered
+	if events, _ := stream.since(0); len(events) != eventBufferSize || events[0].seq != 11 {
+		t.Errorf("buffered %d events starting at %d", len(events), events[0].seq)
+	}
+	stream.finish(nil)
+	if _, err := stream.since(0); err == nil {
+		t.Error("ended stream reports no error")
+	}
+}
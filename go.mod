@@ -0,0 +1,14 @@
+module github.com/gtfierro/bwproxy
+
+go 1.18
+
+require (
+	github.com/BurntSushi/toml v1.2.0
+	github.com/boltdb/bolt v1.3.1
+	github.com/gorilla/websocket v1.2.0
+	github.com/julienschmidt/httprouter v1.3.0
+	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	github.com/pkg/errors v0.9.1
+	github.com/urfave/cli v1.21.0
+	gopkg.in/yaml.v3 v3.0.1
+)
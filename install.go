@@ -0,0 +1,291 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// maximum size of an uploaded bundle
+const maxBundleSize = 100 * 1024 * 1024
+
+var validAppName = regexp.MustCompile("^[A-Za-z0-9][A-Za-z0-9_.-]*$")
+
+// Installs the app contained in the zip or tar.gz bundle at bundlepath into
+// apppath/<name>, where name comes from the bundle's manifest. The bundle may either
+// contain manifest.json at its root or inside a single top level directory.
+// Fails if the app is already installed, unless upgrade is true
+func installBundle(apppath, bundlepath string, upgrade bool) (appManifest, error) {
+	var manifest appManifest
+
+	tmpdir, err := ioutil.TempDir(apppath, ".install-")
+	if err != nil {
+		return manifest, errors.Wrap(err, "Could not create temporary directory")
+	}
+	defer os.RemoveAll(tmpdir)
+
+	if err := unpackBundle(bundlepath, tmpdir); err != nil {
+		return manifest, err
+	}
+
+	// find the root of the app
+	root := tmpdir
+	if _, err := os.Stat(filepath.Join(root, "manifest.json")); os.IsNotExist(err) {
+		entries, err := ioutil.ReadDir(root)
+		if err != nil {
+			return manifest, err
+		}
+		if len(entries) != 1 || !entries[0].IsDir() {
+			return manifest, errors.New("Bundle does not contain manifest.json")
+		}
+		root = filepath.Join(root, entries[0].Name())
+	}
+
+	manifest, err = validateAppDir(root)
+	if err != nil {
+		return manifest, err
+	}
+
+	dest := filepath.Join(apppath, manifest.Name)
+	if _, err := os.Stat(dest); err == nil {
+		if !upgrade {
+			return manifest, errors.Errorf("App %s is already installed", manifest.Name)
+		}
+		// move the old version aside so we can put it back if the rename fails
+		old := filepath.Join(tmpdir, ".old")
+		if err := os.Rename(dest, old); err != nil {
+			return manifest, errors.Wrapf(err, "Could not move old version of %s", manifest.Name)
+		}
+		if err := os.Rename(root, dest); err != nil {
+			os.Rename(old, dest)
+			return manifest, errors.Wrapf(err, "Could not install %s", manifest.Name)
+		}
+		return manifest, nil
+	}
+
+	if err := os.Rename(root, dest); err != nil {
+		return manifest, errors.Wrapf(err, "Could not install %s", manifest.Name)
+	}
+	return manifest, nil
+}
+
+// checks that the directory contains a valid manifest and its entry point
+func validateAppDir(dir string) (appManifest, error) {
+	manifest, err := loadManifest(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, combineErrors(manifest.validate(dir))
+}
+
+// unpacks the zip or tar.gz file into dir
+func unpackBundle(bundlepath, dir string) error {
+	f, err := os.Open(bundlepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	magic, err := bufio.NewReader(f).Peek(4)
+	if err != nil {
+		return errors.Wrap(err, "Could not read bundle")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	switch {
+	case string(magic) == "PK\x03\x04":
+		return unpackZip(f, dir)
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		return unpackTarGz(f, dir)
+	default:
+		return errors.New("Bundle is neither a zip nor a tar.gz file")
+	}
+}
+
+// returns the destination of the bundle entry inside dir, rejecting entries that
+// would be written outside of it
+func bundleEntryPath(dir, name string) (string, error) {
+	dir = filepath.Clean(dir)
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || strings.HasPrefix(name, `\`) {
+		return "", errors.Errorf("Bundle entry %s has an absolute path", name)
+	}
+	dest := filepath.Join(dir, name)
+	if dest != dir && !strings.HasPrefix(dest, dir+string(filepath.Separator)) {
+		return "", errors.Errorf("Bundle entry %s is outside of the app directory", name)
+	}
+	return dest, nil
+}
+
+func writeBundleFile(dest string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func unpackZip(f *os.File, dir string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return errors.Wrap(err, "Could not read zip bundle")
+	}
+	for _, entry := range zr.File {
+		dest, err := bundleEntryPath(dir, entry.Name)
+		if err != nil {
+			return err
+		}
+		mode := entry.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			r, err := entry.Open()
+			if err != nil {
+				return errors.Wrapf(err, "Could not read bundle entry %s", entry.Name)
+			}
+			err = writeBundleFile(dest, r)
+			r.Close()
+			if err != nil {
+				return errors.Wrapf(err, "Could not write bundle entry %s", entry.Name)
+			}
+		default:
+			return errors.Errorf("Bundle entry %s is not a regular file or directory", entry.Name)
+		}
+	}
+	return nil
+}
+
+func unpackTarGz(f *os.File, dir string) error {
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Wrap(err, "Could not read tar.gz bundle")
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "Could not read tar.gz bundle")
+		}
+		dest, err := bundleEntryPath(dir, hdr.Name)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dest, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeBundleFile(dest, tr); err != nil {
+				return errors.Wrapf(err, "Could not write bundle entry %s", hdr.Name)
+			}
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			return errors.Errorf("Bundle entry %s is not a regular file or directory", hdr.Name)
+		}
+	}
+}
+
+// grants the installed app a key for the entity with the given vk. The key carries the
+// permissions requested in the app's manifest, unless perms is provided. Returns the
+// id of the key
+func grantApp(registry *registry, apppath, name, vk string, perms *Permissions) (string, error) {
+	manifest, err := validateAppDir(filepath.Join(apppath, name))
+	if err != nil {
+		return "", err
+	}
+	if perms == nil {
+		perms = &manifest.Permissions
+	}
+	if registry.getClientForVK(vk) == nil {
+		return "", errors.Errorf("No loaded entity with vk %s", vk)
+	}
+	granted := *perms
+	granted.VK = vk
+	if err := granted.validate(); err != nil {
+		return "", err
+	}
+	return registry.grantApp(manifest.Name, granted)
+}
+
+func installApp(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify bundle file")
+	}
+	manifest, err := installBundle(cfg.AppPath, c.Args().Get(0), c.Bool("upgrade"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Installed %s version %s\n", manifest.Name, manifest.Version)
+
+	if vk := c.String("grant"); vk != "" {
+		registry := newRegistry(cfg.StaticPath+"/.registry.db", cfg.BOSSWAVEAgent)
+		id, err := grantApp(registry, cfg.AppPath, manifest.Name, vk, nil)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Granted %s key %s\n", manifest.Name, id)
+	}
+	return nil
+}
+
+func grantAppCmd(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 2 {
+		log.Fatal("Need to specify app name and entity vk")
+	}
+	name := c.Args().Get(0)
+	registry := newRegistry(cfg.StaticPath+"/.registry.db", cfg.BOSSWAVEAgent)
+
+	var perms *Permissions
+	if permissionsfile := c.String("permissions"); permissionsfile != "" {
+		f, err := os.Open(permissionsfile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		perms = new(Permissions)
+		if err := json.NewDecoder(f).Decode(perms); err != nil {
+			return err
+		}
+	}
+	id, err := grantApp(registry, cfg.AppPath, name, c.Args().Get(1), perms)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Granted %s key %s\n", name, id)
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a file in a test bundle; link is set for symlinks
+type bundleFile struct {
+	name, contents, link string
+}
+
+func writeZip(t *testing.T, path string, files []bundleFile) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, file := range files {
+		hdr := &zip.FileHeader{Name: file.name, Method: zip.Deflate}
+		hdr.SetMode(0644)
+		contents := file.contents
+		if file.link != "" {
+			hdr.SetMode(os.ModeSymlink | 0777)
+			contents = file.link
+		}
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(contents))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTarGz(t *testing.T, path string, files []bundleFile) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		hdr := &tar.Header{Name: file.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(file.contents))}
+		if file.link != "" {
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = file.link
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if file.link == "" {
+			tw.Write([]byte(file.contents))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBundleEntryPath(t *testing.T) {
+	dir := filepath.FromSlash("/srv/apps/.install-1")
+	for _, test := range []struct {
+		name string
+		dest string
+	}{
+		{"manifest.json", "/srv/apps/.install-1/manifest.json"},
+		{"demo/js/app.js", "/srv/apps/.install-1/demo/js/app.js"},
+		{"demo/../index.html", "/srv/apps/.install-1/index.html"},
+		{"./index.html", "/srv/apps/.install-1/index.html"},
+		{"demo/", "/srv/apps/.install-1/demo"},
+		{"../evil", ""},
+		{"demo/../../evil", ""},
+		{"../.install-10/evil", ""},
+		{"/etc/passwd", ""},
+		{`\evil`, ""},
+	} {
+		dest, err := bundleEntryPath(dir, test.name)
+		if test.dest == "" {
+			if err == nil {
+				t.Errorf("bundleEntryPath(%q) = %q, want error", test.name, dest)
+			}
+			continue
+		}
+		if err != nil || dest != filepath.FromSlash(test.dest) {
+			t.Errorf("bundleEntryPath(%q) = %q, %v; want %q", test.name, dest, err, test.dest)
+		}
+	}
+}
+
+func TestInstallBundle(t *testing.T) {
+	manifest := `{"Name": "demo", "Version": "1.0"}`
+	for _, test := range []struct {
+		name  string
+		files []bundleFile
+		ok    bool
+	}{
+		{"manifest at the root", []bundleFile{{name: "manifest.json", contents: manifest}, {name: "index.html"}}, true},
+		{"single top level directory", []bundleFile{{name: "demo/manifest.json", contents: manifest}, {name: "demo/index.html"}}, true},
+		{"no manifest", []bundleFile{{name: "index.html"}}, false},
+		{"missing entry point", []bundleFile{{name: "manifest.json", contents: manifest}}, false},
+		{"parent directory", []bundleFile{{name: "manifest.json", contents: manifest}, {name: "index.html"}, {name: "../../evil", contents: "x"}}, false},
+		{"absolute path", []bundleFile{{name: "manifest.json", contents: manifest}, {name: "index.html"}, {name: "/tmp/evil", contents: "x"}}, false},
+		{"symlink", []bundleFile{{name: "manifest.json", contents: manifest}, {name: "index.html", link: "/etc/passwd"}}, false},
+		{"manifest name with path", []bundleFile{{name: "manifest.json", contents: `{"Name": "../evil", "Version": "1"}`}, {name: "index.html"}}, false},
+	} {
+		for _, format := range []string{"zip", "tar.gz"} {
+			dir := t.TempDir()
+			apppath := filepath.Join(dir, "apps")
+			os.Mkdir(apppath, 0755)
+			bundle := filepath.Join(dir, "bundle."+format)
+			if format == "zip" {
+				writeZip(t, bundle, test.files)
+			} else {
+				writeTarGz(t, bundle, test.files)
+			}
+
+			_, err := installBundle(apppath, bundle, false)
+			if (err == nil) != test.ok {
+				t.Errorf("%s (%s): %v, want ok=%v", test.name, format, err, test.ok)
+			}
+			// nothing may be written outside of the apps directory
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != 2 {
+				t.Errorf("%s (%s): files written outside of the apps directory: %v", test.name, format, entries)
+			}
+			// and failed installs leave nothing behind
+			installed, _ := os.ReadDir(apppath)
+			if want := map[bool]int{true: 1, false: 0}[test.ok]; len(installed) != want {
+				t.Errorf("%s (%s): %d entries in the apps directory, want %d", test.name, format, len(installed), want)
+			}
+		}
+	}
+}
+
+func TestInstallBundleUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	apppath := filepath.Join(dir, "apps")
+	os.Mkdir(apppath, 0755)
+	bundle := filepath.Join(dir, "demo.zip")
+	files := func(version string) []bundleFile {
+		return []bundleFile{{name: "manifest.json", contents: `{"Name": "demo", "Version": "` + version + `"}`}, {name: "index.html"}}
+	}
+
+	writeZip(t, bundle, files("1"))
+	if _, err := installBundle(apppath, bundle, false); err != nil {
+		t.Fatal(err)
+	}
+	writeZip(t, bundle, files("2"))
+	if _, err := installBundle(apppath, bundle, false); err == nil {
+		t.Error("installed over an existing app without upgrade")
+	}
+	if _, err := installBundle(apppath, bundle, true); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := loadManifest(filepath.Join(apppath, "demo", "manifest.json"))
+	if err != nil || manifest.Version != "2" {
+		t.Errorf("upgraded manifest: %+v, %v", manifest, err)
+	}
+}
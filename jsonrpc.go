@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// JSON-RPC 2.0 (http://www.jsonrpc.org/specification) on /rpc. The method is the
+// name of the procedure ("query", "publish") and params are the parameters of the
+// procedure, by name. The API key is sent as a bearer token (Authorization: Bearer <key>)
+// or as the "key" member of params; requests through an app may leave it out. As on
+// /call, the rate limit headers describe the key of the request (for a batch, the last
+// request whose key was accepted)
+
+// standard JSON-RPC error codes
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+)
+
+// JSON-RPC codes of our errors; -32000 to -32099 are reserved for the server
+var jsonrpcErrorCodes = map[string]int{
+	codeBadRequest:    jsonrpcInvalidRequest,
+	codeInvalidParams: jsonrpcInvalidParams,
+	codeInternal:      jsonrpcInternalError,
+	codeUnauthorized:  -32001,
+	codeForbidden:     -32003,
+	codeRouter:        -32002,
+	codeTimeout:       -32004,
+	codeRateLimited:   -32029,
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	// empty for notifications; an explicit null id still gets a response
+	ID json.RawMessage `json:"id"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	// the rpcError, with our code, details and whether it is retryable
+	Data *rpcError `json:"data,omitempty"`
+}
+
+func newJSONRPCError(err error) *jsonrpcError {
+	rerr := asRPCError(err)
+	code, found := jsonrpcErrorCodes[rerr.Code]
+	if !found {
+		code = jsonrpcInternalError
+	}
+	return &jsonrpcError{Code: code, Message: rerr.Message, Data: rerr}
+}
+
+// the id of a response to a request whose id could not be determined
+var nullID = json.RawMessage("null")
+
+func (srv *proxyServer) doJSONRPC(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	rw.Header().Set("Content-Type", "application/json")
+
+	var body json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeJSONRPC(rw, jsonrpcResponse{JSONRPC: "2.0", ID: nullID, Error: &jsonrpcError{Code: jsonrpcParseError, Message: err.Error()}})
+		return
+	}
+	bearer := bearerKey(req)
+
+	// a single request
+	if !isBatch(body) {
+		resp, perms := srv.handleJSONRPC(req.Context(), bearer, body)
+		if perms.ID != "" {
+			srv.usage.setHeaders(rw, perms)
+		}
+		if resp != nil {
+			writeJSONRPC(rw, *resp)
+		} else {
+			rw.WriteHeader(http.StatusNoContent)
+		}
+		return
+	}
+
+	// a batch
+	var batch []json.RawMessage
+	if err := json.Unmarshal(body, &batch); err != nil || len(batch) == 0 {
+		writeJSONRPC(rw, jsonrpcResponse{JSONRPC: "2.0", ID: nullID, Error: &jsonrpcError{Code: jsonrpcInvalidRequest, Message: "Invalid batch"}})
+		return
+	}
+	if len(batch) > maxBatchSize {
+		writeJSONRPC(rw, jsonrpcResponse{JSONRPC: "2.0", ID: nullID, Error: &jsonrpcError{Code: jsonrpcInvalidRequest, Message: "Batch is too large"}})
+		return
+	}
+	results := make([]*jsonrpcResponse, len(batch))
+	perms := make([]Permissions, len(batch))
+	ctx, cancel := context.WithTimeout(req.Context(), batchTimeout)
+	defer cancel()
+	srv.forEachParallel(len(batch), func(i int) {
+		results[i], perms[i] = srv.handleJSONRPC(ctx, bearer, batch[i])
+	})
+	if last := lastAuthorized(perms); last.ID != "" {
+		srv.usage.setHeaders(rw, last)
+	}
+	responses := []jsonrpcResponse{}
+	for _, resp := range results {
+		if resp != nil {
+			responses = append(responses, *resp)
+		}
+	}
+	// nothing is returned for a batch of notifications
+	if len(responses) == 0 {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSONRPC(rw, responses)
+}
+
+// runs a single JSON-RPC request; returns nil for notifications. Also returns the
+// permissions of the key once it has been authorized
+func (srv *proxyServer) handleJSONRPC(ctx context.Context, bearer string, body json.RawMessage) (*jsonrpcResponse, Permissions) {
+	var rpcreq jsonrpcRequest
+	var perms Permissions
+	if err := json.Unmarshal(body, &rpcreq); err != nil || rpcreq.JSONRPC != "2.0" || rpcreq.Method == "" {
+		return &jsonrpcResponse{JSONRPC: "2.0", ID: nullID, Error: &jsonrpcError{Code: jsonrpcInvalidRequest, Message: "Invalid request"}}, perms
+	}
+	call, err := jsonrpcCall(bearer, rpcreq)
+	var resp *jsonrpcResponse
+	if err != nil {
+		resp = &jsonrpcResponse{JSONRPC: "2.0", Error: err}
+	} else if ctx.Err() != nil {
+		// the batch ran out of time before this request started
+		resp = &jsonrpcResponse{JSONRPC: "2.0", Error: newJSONRPCError(ctx.Err())}
+	} else {
+		var results []byte
+		var err error
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		results, perms, err = srv.runCall(ctx, call)
+		cancel()
+		if err != nil {
+			resp = &jsonrpcResponse{JSONRPC: "2.0", Error: newJSONRPCError(err)}
+		} else {
+			if len(results) == 0 {
+				results = []byte("null")
+			}
+			resp = &jsonrpcResponse{JSONRPC: "2.0", Result: results}
+		}
+	}
+	if len(rpcreq.ID) == 0 {
+		return nil, perms
+	}
+	resp.ID = rpcreq.ID
+	return resp, perms
+}
+
+// converts the JSON-RPC request into a call
+func jsonrpcCall(bearer string, rpcreq jsonrpcRequest) (BWRPCCall, *jsonrpcError) {
+	call := BWRPCCall{Proc: parseProcedure(rpcreq.Method)}
+	if call.Proc == UNKNOWN {
+		return call, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "No method " + rpcreq.Method}
+	}
+	if call.Proc == SUBSCRIBE {
+		return call, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: "Subscriptions are only available on /streaming and /events"}
+	}
+	// parameters are only accepted by name
+	var params map[string]interface{}
+	if len(rpcreq.Params) > 0 {
+		if err := json.Unmarshal(rpcreq.Params, &params); err != nil {
+			return call, &jsonrpcError{Code: jsonrpcInvalidParams, Message: "Params must be an object"}
+		}
+	}
+	call.Params = make(map[string]interface{})
+	for name, value := range params {
+		if name == "key" {
+			continue
+		}
+		call.Params[name] = value
+	}
+	call.Key = bearer
+	if call.Key == "" {
+		call.Key = getString("key", params)
+	}
+	return call, nil
+}
+
+func writeJSONRPC(rw http.ResponseWriter, v interface{}) {
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Error(errors.Wrap(err, "Could not write JSON-RPC response"))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONRPCCall(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		bearer string
+		body   string
+		code   int
+		key    string
+	}{
+		{"named params", "", `{"jsonrpc": "2.0", "method": "query", "params": {"uri": "a/b", "key": "k"}, "id": 1}`, 0, "k"},
+		{"bearer key wins", "bearer", `{"jsonrpc": "2.0", "method": "query", "params": {"uri": "a/b", "key": "k"}, "id": 1}`, 0, "bearer"},
+		{"no params", "", `{"jsonrpc": "2.0", "method": "list", "id": 1}`, 0, ""},
+		{"array params", "", `{"jsonrpc": "2.0", "method": "query", "params": ["a/b"], "id": 1}`, jsonrpcInvalidParams, ""},
+		{"string params", "", `{"jsonrpc": "2.0", "method": "query", "params": "a/b", "id": 1}`, jsonrpcInvalidParams, ""},
+		{"unknown method", "", `{"jsonrpc": "2.0", "method": "frobnicate", "id": 1}`, jsonrpcMethodNotFound, ""},
+		{"subscribe", "", `{"jsonrpc": "2.0", "method": "subscribe", "params": {"uri": "a/b"}, "id": 1}`, jsonrpcMethodNotFound, ""},
+	} {
+		var rpcreq jsonrpcRequest
+		if err := json.Unmarshal([]byte(test.body), &rpcreq); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		call, err := jsonrpcCall(test.bearer, rpcreq)
+		if test.code != 0 {
+			if err == nil || err.Code != test.code {
+				t.Errorf("%s: got error %+v, want code %d", test.name, err, test.code)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %+v", test.name, err)
+			continue
+		}
+		if call.Key != test.key {
+			t.Errorf("%s: got key %q, want %q", test.name, call.Key, test.key)
+		}
+		if _, found := call.Params["key"]; found {
+			t.Errorf("%s: key left in params", test.name)
+		}
+	}
+}
+
+func TestJSONRPCErrorCodes(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code int
+	}{
+		{rpcErrorf(codeBadRequest, "bad"), jsonrpcInvalidRequest},
+		{rpcErrorf(codeInvalidParams, "uri"), jsonrpcInvalidParams},
+		{rpcErrorf(codeUnauthorized, "who"), -32001},
+		{rpcErrorf(codeForbidden, "no"), -32003},
+		{&limitError{msg: "slow down"}, -32029},
+		{rpcErrorf("something new", "?"), jsonrpcInternalError},
+	} {
+		if got := newJSONRPCError(test.err); got.Code != test.code {
+			t.Errorf("%v: got code %d, want %d", test.err, got.Code, test.code)
+		}
+	}
+}
+
+// like /call, /rpc describes the rate limits of the key in headers
+func TestJSONRPCRateLimitHeaders(t *testing.T) {
+	srv, _, _ := newTestProxy(t)
+	key := "limited key"
+	srv.registry.addPermissions(key, Permissions{Query: QueryPermission{Allowed: true}, Limits: Limits{CallsPerSecond: 1, CallBurst: 5}})
+
+	for _, body := range []string{
+		`{"jsonrpc": "2.0", "method": "query", "params": {"uri": "a/b"}, "id": 1}`,
+		`[{"jsonrpc": "2.0", "method": "query", "params": {"uri": "a/b"}, "id": 1}, {"jsonrpc": "2.0", "method": "query", "params": {"uri": "a/b", "key": "wrong"}, "id": 2}]`,
+	} {
+		req := httptest.NewRequest("POST", "http://localhost:2222/rpc", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+key)
+		rw := httptest.NewRecorder()
+		srv.doJSONRPC(rw, req, nil)
+		if rw.Header().Get("X-RateLimit-Limit") != "5" || rw.Header().Get("X-RateLimit-Remaining") == "" {
+			t.Errorf("%s: missing rate limit headers %v", body, rw.Header())
+		}
+	}
+}
+
+// notifications have no id; a null id is a request and is answered
+func TestJSONRPCNullID(t *testing.T) {
+	srv, _, _ := newTestProxy(t)
+	for _, test := range []struct {
+		body   string
+		status int
+		id     string
+	}{
+		{`{"jsonrpc": "2.0", "method": "frobnicate", "id": 7}`, 200, "7"},
+		{`{"jsonrpc": "2.0", "method": "frobnicate", "id": null}`, 200, "null"},
+		{`{"jsonrpc": "2.0", "method": "frobnicate"}`, 204, ""},
+	} {
+		req := httptest.NewRequest("POST", "http://localhost:2222/rpc", strings.NewReader(test.body))
+		rw := httptest.NewRecorder()
+		srv.doJSONRPC(rw, req, nil)
+		if rw.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.body, rw.Code, test.status)
+			continue
+		}
+		if test.status != 200 {
+			continue
+		}
+		var resp jsonrpcResponse
+		if err := json.Unmarshal(rw.Body.Bytes(), &resp); err != nil {
+			t.Errorf("%s: %v", test.body, err)
+			continue
+		}
+		if string(resp.ID) != test.id || resp.Error == nil || resp.Error.Code != jsonrpcMethodNotFound {
+			t.Errorf("%s: got id %s and error %+v", test.body, resp.ID, resp.Error)
+		}
+	}
+}
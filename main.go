@@ -10,6 +10,8 @@ import (
 // logger
 var log *logging.Logger
 
+const proxyVersion = "0.1.0"
+
 // set up logging facilities
 func init() {
 	log = logging.MustGetLogger("bwproxy")
@@ -20,33 +22,204 @@ func init() {
 	logging.SetFormatter(logging.MustStringFormatter(format))
 }
 
-type Config struct {
-	Port           string
-	ListenAddress  string
-	StaticPath     string
-	AppPath        string
-	PortRangeStart int
-	UseIPv6        bool
-	BOSSWAVEAgent  string
-}
-
 func main() {
 	app := cli.NewApp()
 	app.Name = "bwproxy"
-	app.Version = "0.1.0"
+	app.Version = proxyVersion
 	app.Usage = "BOSSWAVE HTTP Proxy for sandboxed applications"
+	app.Flags = configFlags
 
 	app.Commands = []cli.Command{
 		{
-			Name:   "register",
-			Usage:  "Register a new API key",
-			Action: doRegister,
+			Name:      "register",
+			Usage:     "Register a new API key",
+			ArgsUsage: "<entity file> <permissions file>",
+			Action:    doRegister,
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "ttl",
+					Usage: "How long the key is valid for (e.g. 72h). Never expires if 0",
+				},
+				cli.StringFlag{
+					Name:  "app",
+					Usage: "Bind the key to this app",
+				},
+			},
 		},
 		{
 			Name:   "run",
 			Usage:  "Run the proxy",
 			Action: runProxy,
 		},
+		{
+			Name:  "keys",
+			Usage: "Manage API keys",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "List registered API keys",
+					Action: listKeys,
+				},
+				{
+					Name:      "show",
+					Usage:     "Show the permissions for an API key",
+					ArgsUsage: "<key or key id>",
+					Action:    showKey,
+				},
+				{
+					Name:      "revoke",
+					Usage:     "Revoke an API key",
+					ArgsUsage: "<key or key id>",
+					Action:    revokeKey,
+				},
+				{
+					Name:      "rotate",
+					Usage:     "Replace an API key with a new key carrying the same permissions",
+					ArgsUsage: "<key or key id>",
+					Action:    rotateKey,
+					Flags: []cli.Flag{
+						cli.DurationFlag{
+							Name:  "grace",
+							Usage: "How long the old key keeps working (e.g. 24h). Revoked immediately if 0",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "app",
+			Usage: "Manage applications",
+			Subcommands: []cli.Command{
+				{
+					Name:      "install",
+					Usage:     "Install an app from a zip or tar.gz bundle",
+					ArgsUsage: "<bundle>",
+					Action:    installApp,
+					Flags: []cli.Flag{
+						cli.BoolFlag{
+							Name:  "upgrade",
+							Usage: "Replace the app if it is already installed",
+						},
+						cli.StringFlag{
+							Name:  "grant",
+							Usage: "Grant the app the permissions its manifest requests, using the entity with this vk",
+						},
+					},
+				},
+				{
+					Name:      "validate",
+					Usage:     "Check an app directory against the manifest schema",
+					ArgsUsage: "<dir>",
+					Action:    validateApp,
+				},
+				{
+					Name:      "grant",
+					Usage:     "Create the key an app's requests are authorized with",
+					ArgsUsage: "<name> <entity vk>",
+					Action:    grantAppCmd,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "permissions",
+							Usage: "Permissions JSON file to grant instead of the permissions requested by the manifest",
+						},
+					},
+				},
+				{
+					Name:  "config",
+					Usage: "Show and change the configuration of an installed app",
+					Subcommands: []cli.Command{
+						{
+							Name:      "show",
+							Usage:     "Show the app's config options and their values",
+							ArgsUsage: "<name>",
+							Action:    showAppConfig,
+						},
+						{
+							Name:      "set",
+							Usage:     "Set a config option (the value is parsed as JSON, or else taken as a string)",
+							ArgsUsage: "<name> <option> <value>",
+							Action:    setAppConfig,
+						},
+						{
+							Name:      "unset",
+							Usage:     "Reset a config option to its default",
+							ArgsUsage: "<name> <option>",
+							Action:    unsetAppConfig,
+						},
+					},
+				},
+				{
+					Name:  "storage",
+					Usage: "Back up and restore the storage of an app",
+					Subcommands: []cli.Command{
+						{
+							Name:      "export",
+							Usage:     "Write the app's storage as JSON to a file (or stdout)",
+							ArgsUsage: "<name> [file]",
+							Action:    exportStorage,
+						},
+						{
+							Name:      "import",
+							Usage:     "Replace the app's storage with the contents of an exported file",
+							ArgsUsage: "<name> <file>",
+							Action:    importStorage,
+						},
+					},
+				},
+				{
+					Name:      "stop",
+					Usage:     "Stop a running app",
+					ArgsUsage: "<name>",
+					Action:    stopApp,
+				},
+				{
+					Name:      "restart",
+					Usage:     "Restart a running app",
+					ArgsUsage: "<name>",
+					Action:    restartApp,
+				},
+				{
+					Name:      "uninstall",
+					Usage:     "Stop an app, remove it and revoke the keys bound to it",
+					ArgsUsage: "<name>",
+					Action:    uninstallApp,
+				},
+			},
+		},
+		{
+			Name:   "audit",
+			Usage:  "Search the audit log",
+			Action: searchAudit,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "key",
+					Usage: "Only show entries for this API key or key id",
+				},
+				cli.StringFlag{
+					Name:  "uri",
+					Usage: "Only show entries for this URI or URIs under it",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Only show entries at or after this RFC 3339 time",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Only show entries at or before this RFC 3339 time",
+				},
+			},
+		},
+		{
+			Name:  "config",
+			Usage: "Configuration utilities",
+			Subcommands: []cli.Command{
+				{
+					Name:   "print",
+					Usage:  "Print the effective configuration",
+					Action: printConfig,
+				},
+			},
+		},
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// version of the manifest schema understood by this proxy. Manifests without a
+// ManifestVersion are treated as version 1
+const manifestVersion = 1
+
+var validHostname = regexp.MustCompile("^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$")
+
+type appManifest struct {
+	// version of the manifest schema
+	ManifestVersion int `json:",omitempty"`
+	Name            string
+	Description     string
+	Version         string
+	Author          string `json:",omitempty"`
+	// URL of the app's home page
+	Homepage string `json:",omitempty"`
+	// path of the app's icon, relative to the app directory
+	Icon string `json:",omitempty"`
+	// page served at the root of the app, relative to the app directory; defaults
+	// to index.html
+	EntryPoint string `json:",omitempty"`
+	// hostname the app would like to be served under in shared port mode, e.g. "demo"
+	// for demo.<AppDomain>; defaults to the app name
+	Hostname string `json:",omitempty"`
+	// oldest version of bwproxy the app works with
+	MinProxyVersion string `json:",omitempty"`
+	// permissions the app needs; an admin grants them (with an entity) to create the
+	// key the app's requests are authorized with
+	Permissions Permissions
+	// configuration options the app accepts; the values set by an admin are served
+	// to the app at /config
+	Config map[string]configOption `json:",omitempty"`
+	// not going to be populated by the manifest
+	Address string
+}
+
+// returns the entry point of the app, relative to its directory
+func (manifest appManifest) entryPoint() string {
+	if manifest.EntryPoint == "" {
+		return "index.html"
+	}
+	return manifest.EntryPoint
+}
+
+// returns the hostname the app is served under in shared port mode
+func (manifest appManifest) hostname() string {
+	if manifest.Hostname == "" {
+		return strings.ToLower(manifest.Name)
+	}
+	return manifest.Hostname
+}
+
+// reads the manifest file at the given path
+func loadManifest(path string) (appManifest, error) {
+	var manifest appManifest
+	file, err := os.Open(path)
+	if err != nil {
+		return manifest, errors.Wrapf(err, "Could not open manifest %s", path)
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&manifest); err != nil {
+		return manifest, errors.Wrapf(err, "Could not decode manifest %s", path)
+	}
+	return manifest, nil
+}
+
+// loads and validates the manifest of the app installed in dir, whose name must
+// match the directory's
+func loadAppManifest(dir string) (appManifest, []error) {
+	manifest, err := loadManifest(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return manifest, []error{err}
+	}
+	errs := manifest.validate(dir)
+	if name := filepath.Base(dir); manifest.Name != name {
+		errs = append(errs, errors.Errorf("Name %q does not match app directory %s", manifest.Name, name))
+	}
+	return manifest, errs
+}
+
+// checks the manifest of the app installed in dir against the schema and returns
+// every problem found
+func (manifest appManifest) validate(dir string) []error {
+	var errs []error
+	if manifest.ManifestVersion < 0 || manifest.ManifestVersion > manifestVersion {
+		errs = append(errs, errors.Errorf("Unsupported ManifestVersion %d (this proxy supports up to %d)", manifest.ManifestVersion, manifestVersion))
+	}
+	if !validAppName.MatchString(manifest.Name) {
+		errs = append(errs, errors.Errorf("Invalid app name %q", manifest.Name))
+	}
+	if manifest.Version == "" {
+		errs = append(errs, errors.New("Missing Version"))
+	}
+	if manifest.Homepage != "" {
+		if u, err := url.Parse(manifest.Homepage); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, errors.Errorf("Homepage %q is not an http(s) URL", manifest.Homepage))
+		}
+	}
+	if manifest.Icon != "" {
+		if err := checkAppFile(dir, manifest.Icon); err != nil {
+			errs = append(errs, errors.Wrap(err, "Invalid Icon"))
+		}
+	}
+	if err := checkAppFile(dir, manifest.entryPoint()); err != nil {
+		errs = append(errs, errors.Wrap(err, "Invalid EntryPoint"))
+	}
+	if manifest.Hostname != "" && !validHostname.MatchString(manifest.Hostname) {
+		errs = append(errs, errors.Errorf("Invalid Hostname %q", manifest.Hostname))
+	}
+	if manifest.MinProxyVersion != "" {
+		if cmp, err := compareVersions(proxyVersion, manifest.MinProxyVersion); err != nil {
+			errs = append(errs, errors.Wrap(err, "Invalid MinProxyVersion"))
+		} else if cmp < 0 {
+			errs = append(errs, errors.Errorf("App requires bwproxy %s or newer (this is %s)", manifest.MinProxyVersion, proxyVersion))
+		}
+	}
+	if err := manifest.Permissions.validate(); err != nil {
+		errs = append(errs, errors.Wrap(err, "Invalid Permissions"))
+	}
+	errs = append(errs, validateConfigSchema(manifest.Config)...)
+	return errs
+}
+
+// checks that the path names a regular file inside the app directory
+func checkAppFile(dir, path string) error {
+	if filepath.IsAbs(path) {
+		return errors.Errorf("%s is not relative to the app directory", path)
+	}
+	full, err := bundleEntryPath(dir, path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(full)
+	if err != nil {
+		return errors.Errorf("%s does not exist", path)
+	}
+	if !info.Mode().IsRegular() {
+		return errors.Errorf("%s is not a file", path)
+	}
+	return nil
+}
+
+// compares two dotted numeric versions (e.g. 0.1.0); returns -1, 0 or 1
+func compareVersions(a, b string) (int, error) {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		var err error
+		if i < len(as) {
+			if x, err = strconv.Atoi(as[i]); err != nil {
+				return 0, errors.Errorf("Invalid version %q", a)
+			}
+		}
+		if i < len(bs) {
+			if y, err = strconv.Atoi(bs[i]); err != nil {
+				return 0, errors.Errorf("Invalid version %q", b)
+			}
+		}
+		if x < y {
+			return -1, nil
+		} else if x > y {
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// joins the errors into a single error
+func combineErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+func validateApp(c *cli.Context) error {
+	if c.NArg() != 1 {
+		log.Fatal("Need to specify app directory")
+	}
+	dir := c.Args().Get(0)
+	manifest, err := loadManifest(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	errs := manifest.validate(dir)
+	if name := filepath.Base(filepath.Clean(dir)); name != manifest.Name {
+		log.Warningf("Directory name %s does not match app name %s; it will be installed as %s", name, manifest.Name, manifest.Name)
+	}
+	for _, err := range errs {
+		log.Error(err)
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("%s is not a valid app", dir)
+	}
+	log.Noticef("%s (%s version %s) is valid", dir, manifest.Name, manifest.Version)
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		cmp  int
+		ok   bool
+	}{
+		{"0.1.0", "0.1.0", 0, true},
+		{"0.1", "0.1.0", 0, true},
+		{"v1.2.3", "1.2.3", 0, true},
+		{"0.1.0", "0.2.0", -1, true},
+		{"0.10.0", "0.9.0", 1, true},
+		{"1", "0.99.99", 1, true},
+		{"1.2.3", "1.2.3.1", -1, true},
+		{"1.x", "1.0", 0, false},
+		{"1.0", "", 0, false},
+		{"1.0-beta", "1.0", 0, false},
+	} {
+		cmp, err := compareVersions(test.a, test.b)
+		if (err == nil) != test.ok || (test.ok && cmp != test.cmp) {
+			t.Errorf("compareVersions(%q, %q) = %d, %v; want %d, ok=%v", test.a, test.b, cmp, err, test.cmp, test.ok)
+		}
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"index.html", "main.html", "icon.png"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "static"), 0755)
+
+	valid := appManifest{Name: "demo", Version: "1.0"}
+	for _, test := range []struct {
+		name   string
+		modify func(m *appManifest)
+		errors int
+	}{
+		{"minimal", func(m *appManifest) {}, 0},
+		{"everything", func(m *appManifest) {
+			m.ManifestVersion = manifestVersion
+			m.Homepage = "https://example.com/demo"
+			m.Icon = "icon.png"
+			m.EntryPoint = "main.html"
+			m.Hostname = "demo-app"
+			m.MinProxyVersion = proxyVersion
+			m.Permissions = Permissions{Query: QueryPermission{Allowed: true, URIScope: URIScope{AllowURIs: []string{"scratch.ns/*"}}}}
+			m.Config = map[string]configOption{"uri": {Type: "string", Default: "scratch.ns/demo"}}
+		}, 0},
+		{"future manifest version", func(m *appManifest) { m.ManifestVersion = manifestVersion + 1 }, 1},
+		{"bad name", func(m *appManifest) { m.Name = "../demo" }, 1},
+		{"empty name", func(m *appManifest) { m.Name = "" }, 1},
+		{"missing version", func(m *appManifest) { m.Version = "" }, 1},
+		{"homepage not http", func(m *appManifest) { m.Homepage = "javascript:alert(1)" }, 1},
+		{"missing icon", func(m *appManifest) { m.Icon = "missing.png" }, 1},
+		{"icon outside app", func(m *appManifest) { m.Icon = "../icon.png" }, 1},
+		{"absolute entry point", func(m *appManifest) { m.EntryPoint = "/etc/passwd" }, 1},
+		{"entry point is a directory", func(m *appManifest) { m.EntryPoint = "static" }, 1},
+		{"uppercase hostname", func(m *appManifest) { m.Hostname = "Demo" }, 1},
+		{"hostname with dots", func(m *appManifest) { m.Hostname = "demo.evil.com" }, 1},
+		{"newer proxy needed", func(m *appManifest) { m.MinProxyVersion = "999.0" }, 1},
+		{"bad proxy version", func(m *appManifest) { m.MinProxyVersion = "latest" }, 1},
+		{"bad permissions", func(m *appManifest) {
+			m.Permissions.Publish.AllowURIs = []string{"scratch.ns/a*"}
+		}, 1},
+		{"bad config", func(m *appManifest) { m.Config = map[string]configOption{"n": {Type: "integer", Default: 1.5}} }, 1},
+		{"several problems", func(m *appManifest) {
+			m.Name = ""
+			m.Version = ""
+			m.Icon = "missing.png"
+		}, 3},
+	} {
+		m := valid
+		test.modify(&m)
+		if errs := m.validate(dir); len(errs) != test.errors {
+			t.Errorf("%s: got errors %v, want %d", test.name, errs, test.errors)
+		}
+	}
+}
+
+func TestLoadAppManifestName(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "demo")
+	os.Mkdir(dir, 0755)
+	os.WriteFile(filepath.Join(dir, "index.html"), nil, 0644)
+	for _, test := range []struct {
+		manifest string
+		errors   int
+	}{
+		{`{"Name": "demo", "Version": "1"}`, 0},
+		{`{"Name": "other", "Version": "1"}`, 1},
+		{`{"Name": "demo", "Version": "1", "Unknown": true}`, 0},
+		{`not json`, 1},
+	} {
+		os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(test.manifest), 0644)
+		if _, errs := loadAppManifest(dir); len(errs) != test.errors {
+			t.Errorf("%s: got errors %v, want %d", test.manifest, errs, test.errors)
+		}
+	}
+}
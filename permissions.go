@@ -1,35 +1,345 @@
 package main
 
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 type Permissions struct {
-	// API key
-	Key string
+	// API key; never stored
+	Key string `json:"-"`
+	// identifier of the API key, safe to display
+	ID string
 	// the (secret) VK of the entity that created this permission
 	VK string
+	// name of the app the key is bound to, if any. Keys bound to an app are
+	// revoked when it is uninstalled
+	App string `json:",omitempty"`
+	// if set, the key does not work before this time
+	NotBefore time.Time
+	// if set, the key stops working after this time
+	NotAfter time.Time
+	// if non-empty, the key only works during these recurring windows
+	Windows []TimeWindow
 	// set of permissions
 	Subscribe SubscribePermission
 	Publish   PublishPermission
 	Query     QueryPermission
+	List      ListPermission
+	// rate limits and quotas
+	Limits Limits
+}
+
+// a recurring time-of-day window, e.g. weekdays from 09:00 to 17:00. If End is
+// before Start, the window runs past midnight into the next day
+type TimeWindow struct {
+	// days of the week (e.g. "Mon") on which the window starts; every day if empty
+	Days []string
+	// start and end of the window as HH:MM
+	Start string
+	End   string
+	// IANA time zone of the window (e.g. "America/Los_Angeles"); defaults to local time
+	Location string
+}
+
+// restricts the URIs an operation can be performed on. Patterns use the BOSSWAVE
+// wildcards: '+' matches exactly one URI element and '*' matches zero or more.
+// If AllowURIs is empty, any URI not matched by DenyURIs is allowed
+type URIScope struct {
+	AllowURIs []string
+	DenyURIs  []string
+}
+
+// restricts the payload object types that can be published or received. Each entry
+// is a dot form PO number, optionally masked (e.g. 2.0.0.0/8). If AllowPOs is empty,
+// any PO type is allowed
+type POScope struct {
+	AllowPOs []string
 }
 
 type SubscribePermission struct {
 	Allowed bool
+	URIScope
+	POScope
 }
 type PublishPermission struct {
 	Allowed bool
+	URIScope
+	POScope
 }
 type QueryPermission struct {
 	Allowed bool
+	URIScope
+	POScope
+}
+type ListPermission struct {
+	Allowed bool
+	URIScope
 }
 
 // returns true if OK, else false
 func checkQueryPermissions(perms Permissions, params BWRPCCall) bool {
-	return perms.Query.Allowed
+	return perms.Query.Allowed && perms.Query.permits(getString("uri", params.Params))
+}
+
+func checkListPermissions(perms Permissions, params BWRPCCall) bool {
+	return perms.List.Allowed && perms.List.permits(getString("uri", params.Params))
 }
 
 func checkSubscribePermissions(perms Permissions, params BWRPCCall) bool {
-	return perms.Subscribe.Allowed
+	return perms.Subscribe.Allowed && perms.Subscribe.permits(getString("uri", params.Params))
 }
 
 func checkPublishPermissions(perms Permissions, params BWRPCCall) bool {
-	return perms.Publish.Allowed
+	return perms.Publish.Allowed && perms.Publish.permits(getString("uri", params.Params)) &&
+		perms.Publish.permitsPO(getString("ponum", params.Params))
+}
+
+// checks that the patterns in all scopes are well formed
+func (perms Permissions) validate() error {
+	for _, scope := range []URIScope{perms.Subscribe.URIScope, perms.Publish.URIScope, perms.Query.URIScope, perms.List.URIScope} {
+		for _, patterns := range [][]string{scope.AllowURIs, scope.DenyURIs} {
+			for _, pattern := range patterns {
+				if err := validateURIPattern(pattern); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for _, window := range perms.Windows {
+		if err := window.validate(); err != nil {
+			return err
+		}
+	}
+	for _, scope := range []POScope{perms.Subscribe.POScope, perms.Publish.POScope, perms.Query.POScope} {
+		for _, mask := range scope.AllowPOs {
+			if err := validatePOMask(mask); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// returns an error if the key is not usable at time t
+func (perms Permissions) checkValidAt(t time.Time) error {
+	if !perms.NotBefore.IsZero() && t.Before(perms.NotBefore) {
+		return errors.Errorf("API key is not valid until %s", perms.NotBefore.Format(time.RFC3339))
+	}
+	if !perms.NotAfter.IsZero() && !t.Before(perms.NotAfter) {
+		return errors.New("API key has expired")
+	}
+	if len(perms.Windows) == 0 {
+		return nil
+	}
+	for _, window := range perms.Windows {
+		if _, in := window.endOf(t); in {
+			return nil
+		}
+	}
+	return errors.New("API key is not valid at this time of day")
+}
+
+// returns the time at which a key that is valid at t stops being valid, or the
+// zero time if it stays valid forever. The key may still be valid at the returned
+// time if another window starts right as the current one ends
+func (perms Permissions) validUntil(t time.Time) time.Time {
+	until := perms.NotAfter
+	if len(perms.Windows) == 0 {
+		return until
+	}
+	var windowEnd time.Time
+	for _, window := range perms.Windows {
+		if end, in := window.endOf(t); in && end.After(windowEnd) {
+			windowEnd = end
+		}
+	}
+	if until.IsZero() || windowEnd.Before(until) {
+		return windowEnd
+	}
+	return until
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (w TimeWindow) validate() error {
+	if _, err := time.Parse("15:04", w.Start); err != nil {
+		return errors.Wrapf(err, "Invalid window start %s", w.Start)
+	}
+	if _, err := time.Parse("15:04", w.End); err != nil {
+		return errors.Wrapf(err, "Invalid window end %s", w.End)
+	}
+	if _, err := time.LoadLocation(w.Location); err != nil {
+		return errors.Wrapf(err, "Invalid window location %s", w.Location)
+	}
+	for _, day := range w.Days {
+		if _, found := weekdays[strings.ToLower(day)]; !found {
+			return errors.Errorf("Invalid window day %s", day)
+		}
+	}
+	return nil
+}
+
+func (w TimeWindow) startsOn(day time.Weekday) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if weekdays[strings.ToLower(d)] == day {
+			return true
+		}
+	}
+	return false
+}
+
+// if t falls inside an occurrence of the window, returns the end of that occurrence
+// and true
+func (w TimeWindow) endOf(t time.Time) (time.Time, bool) {
+	loc := time.Local
+	if w.Location != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.Location); err != nil {
+			return time.Time{}, false
+		}
+	}
+	start, err1 := time.Parse("15:04", w.Start)
+	end, err2 := time.Parse("15:04", w.End)
+	if err1 != nil || err2 != nil {
+		return time.Time{}, false
+	}
+	t = t.In(loc)
+	// check the occurrences starting today and (for windows past midnight) yesterday
+	for _, offset := range []int{0, -1} {
+		day := time.Date(t.Year(), t.Month(), t.Day()+offset, 0, 0, 0, 0, loc)
+		if !w.startsOn(day.Weekday()) {
+			continue
+		}
+		from := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), 0, 0, loc)
+		to := time.Date(day.Year(), day.Month(), day.Day(), end.Hour(), end.Minute(), 0, 0, loc)
+		if !to.After(from) {
+			to = to.AddDate(0, 0, 1)
+		}
+		if !t.Before(from) && t.Before(to) {
+			return to, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// a URI (which may itself contain wildcards) is permitted if everything it could
+// match is covered by one of the allowed patterns and nothing it could match is
+// covered by a denied pattern
+func (scope URIScope) permits(uri string) bool {
+	if validateURIPattern(uri) != nil {
+		return false
+	}
+	u := splitURI(uri)
+	for _, pattern := range scope.DenyURIs {
+		if urisOverlap(splitURI(pattern), u) {
+			return false
+		}
+	}
+	if len(scope.AllowURIs) == 0 {
+		return true
+	}
+	for _, pattern := range scope.AllowURIs {
+		if uriCovers(splitURI(pattern), u) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitURI(uri string) []string {
+	return strings.Split(strings.Trim(uri, "/"), "/")
+}
+
+func validateURIPattern(pattern string) error {
+	if strings.Trim(pattern, "/") == "" {
+		return errors.New("Empty URI")
+	}
+	for _, elem := range splitURI(pattern) {
+		if elem == "" {
+			return errors.Errorf("Empty element in URI %s", pattern)
+		}
+		if elem != "*" && elem != "+" && strings.ContainsAny(elem, "*+") {
+			return errors.Errorf("Wildcards must be a whole element in URI %s", pattern)
+		}
+	}
+	return nil
+}
+
+// returns true if every URI matched by uri is also matched by pattern
+func uriCovers(pattern, uri []string) bool {
+	if len(pattern) == 0 {
+		return len(uri) == 0
+	}
+	switch pattern[0] {
+	case "*":
+		return uriCovers(pattern[1:], uri) || (len(uri) > 0 && uriCovers(pattern, uri[1:]))
+	case "+":
+		return len(uri) > 0 && uri[0] != "*" && uriCovers(pattern[1:], uri[1:])
+	default:
+		return len(uri) > 0 && uri[0] == pattern[0] && uriCovers(pattern[1:], uri[1:])
+	}
+}
+
+// returns true if there is some URI matched by both a and b
+func urisOverlap(a, b []string) bool {
+	if len(a) > 0 && a[0] == "*" {
+		return urisOverlap(a[1:], b) || (len(b) > 0 && urisOverlap(a, b[1:]))
+	}
+	if len(b) > 0 && b[0] == "*" {
+		return urisOverlap(b, a)
+	}
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == 0 && len(b) == 0
+	}
+	if a[0] != "+" && b[0] != "+" && a[0] != b[0] {
+		return false
+	}
+	return urisOverlap(a[1:], b[1:])
+}
+
+// returns true if the dot form PO number is matched by one of the allowed masks
+func (scope POScope) permitsPO(ponum string) bool {
+	if len(scope.AllowPOs) == 0 {
+		return true
+	}
+	if validatePOMask(ponum) != nil {
+		return false
+	}
+	for _, mask := range scope.AllowPOs {
+		if isType(ponum, mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// checks that the mask is a (possibly masked) dot form PO number, so that it is safe
+// to pass to isType
+func validatePOMask(mask string) error {
+	parts := strings.SplitN(mask, "/", 2)
+	if len(parts) == 2 {
+		if bits, err := strconv.Atoi(parts[1]); err != nil || bits < 0 || bits > 32 {
+			return errors.Errorf("Invalid mask in PO %s", mask)
+		}
+	}
+	octets := strings.Split(parts[0], ".")
+	if len(octets) != 4 {
+		return errors.Errorf("PO %s is not in dot form", mask)
+	}
+	for _, octet := range octets {
+		if n, err := strconv.Atoi(octet); err != nil || n < 0 || n > 255 {
+			return errors.Errorf("PO %s is not in dot form", mask)
+		}
+	}
+	return nil
 }
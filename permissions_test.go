@@ -0,0 +1,234 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateURIPattern(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		valid   bool
+	}{
+		{"scratch.ns/a", true},
+		{"/scratch.ns/a/", true},
+		{"scratch.ns/+/b", true},
+		{"scratch.ns/*", true},
+		{"*", true},
+		{"", false},
+		{"/", false},
+		{"scratch.ns//a", false},
+		{"scratch.ns/a*", false},
+		{"scratch.ns/+b", false},
+		{"scratch.ns/a+/c", false},
+	} {
+		if err := validateURIPattern(test.pattern); (err == nil) != test.valid {
+			t.Errorf("validateURIPattern(%q) = %v, want valid=%v", test.pattern, err, test.valid)
+		}
+	}
+}
+
+func TestURICovers(t *testing.T) {
+	for _, test := range []struct {
+		pattern, uri string
+		covers       bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a", true},
+		{"a/*", "a/b/c", true},
+		{"a/*", "b/c", false},
+		{"a/*/d", "a/d", true},
+		{"a/*/d", "a/b/c/d", true},
+		{"a/*/d", "a/b/c/e", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a", false},
+		{"a/+", "a/b/c", false},
+		{"a/+/c", "a/+/c", true},
+		// a wildcard in the URI must be covered whatever it matches
+		{"a/+", "a/*", false},
+		{"a/*", "a/*", true},
+		{"a/*", "a/+", true},
+		{"a/b/*", "a/+/c", false},
+	} {
+		if got := uriCovers(splitURI(test.pattern), splitURI(test.uri)); got != test.covers {
+			t.Errorf("uriCovers(%q, %q) = %v, want %v", test.pattern, test.uri, got, test.covers)
+		}
+	}
+}
+
+func TestURIsOverlap(t *testing.T) {
+	for _, test := range []struct {
+		a, b    string
+		overlap bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/*", "a", true},
+		{"a/*", "a/b/c", true},
+		{"a/*", "b", false},
+		{"a/*/d", "a/+/+/d", true},
+		{"a/*/d", "a/b/c", false},
+		{"*/x", "a/*", true},
+		{"a/+/c", "a/b/+", true},
+		{"a/+/c", "a/b/d", false},
+	} {
+		if got := urisOverlap(splitURI(test.a), splitURI(test.b)); got != test.overlap {
+			t.Errorf("urisOverlap(%q, %q) = %v, want %v", test.a, test.b, got, test.overlap)
+		}
+		if got := urisOverlap(splitURI(test.b), splitURI(test.a)); got != test.overlap {
+			t.Errorf("urisOverlap(%q, %q) = %v, want %v", test.b, test.a, got, test.overlap)
+		}
+	}
+}
+
+func TestURIScopePermits(t *testing.T) {
+	scope := URIScope{
+		AllowURIs: []string{"ns/a/*", "ns/b/+/x"},
+		DenyURIs:  []string{"ns/a/secret/*"},
+	}
+	for _, test := range []struct {
+		uri     string
+		permits bool
+	}{
+		{"ns/a", true},
+		{"ns/a/b/c", true},
+		{"ns/a/q/+", true},
+		{"ns/a/q/*", true},
+		{"ns/b/1/x", true},
+		{"ns/b/+/x", true},
+		// could match ns/a/secret
+		{"ns/a/*", false},
+		{"ns/a/+", false},
+		{"ns/a/secret", false},
+		{"ns/a/secret/q", false},
+		{"ns/b/*/x", false},
+		{"ns/b/1/2/x", false},
+		{"ns/c", false},
+		{"ns/a//b", false},
+	} {
+		if got := scope.permits(test.uri); got != test.permits {
+			t.Errorf("permits(%q) = %v, want %v", test.uri, got, test.permits)
+		}
+	}
+	if !(URIScope{}).permits("anything/at/all") {
+		t.Error("an empty scope should permit every URI")
+	}
+}
+
+func TestPOMasks(t *testing.T) {
+	for _, test := range []struct {
+		mask  string
+		valid bool
+	}{
+		{"2.0.0.0/8", true},
+		{"64.0.1.0", true},
+		{"1.2.3.4/32", true},
+		{"1.2.3.4/0", true},
+		{"2.0.0", false},
+		{"2.0.0.0.0", false},
+		{"1.2.3.4/40", false},
+		{"1.2.3.4/-1", false},
+		{"1.2.3.4/x", false},
+		{"256.0.0.0", false},
+		{"a.b.c.d", false},
+	} {
+		if err := validatePOMask(test.mask); (err == nil) != test.valid {
+			t.Errorf("validatePOMask(%q) = %v, want valid=%v", test.mask, err, test.valid)
+		}
+	}
+
+	scope := POScope{AllowPOs: []string{"2.0.0.0/8", "64.0.1.0"}}
+	for _, test := range []struct {
+		ponum   string
+		permits bool
+	}{
+		{"2.0.0.0", true},
+		{"2.0.3.1", true},
+		{"2.255.255.255", true},
+		{"64.0.1.0", true},
+		{"64.0.1.1", false},
+		{"3.0.0.0", false},
+		{"not a po", false},
+		{"", false},
+	} {
+		if got := scope.permitsPO(test.ponum); got != test.permits {
+			t.Errorf("permitsPO(%q) = %v, want %v", test.ponum, got, test.permits)
+		}
+	}
+	if !(POScope{}).permitsPO("1.2.3.4") {
+		t.Error("an empty scope should permit every PO")
+	}
+}
+
+func TestTimeWindows(t *testing.T) {
+	// 2017-06-05 is a Monday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2017, 6, day, hour, min, 0, 0, time.UTC)
+	}
+	overnight := TimeWindow{Days: []string{"Mon"}, Start: "22:00", End: "02:00", Location: "UTC"}
+	office := TimeWindow{Days: []string{"mon", "Tue"}, Start: "09:00", End: "17:00", Location: "UTC"}
+	daily := TimeWindow{Start: "12:00", End: "13:00", Location: "UTC"}
+
+	for _, test := range []struct {
+		name   string
+		window TimeWindow
+		t      time.Time
+		in     bool
+		end    time.Time
+	}{
+		{"overnight, before start", overnight, at(5, 21, 59), false, time.Time{}},
+		{"overnight, at start", overnight, at(5, 22, 0), true, at(6, 2, 0)},
+		{"overnight, past midnight", overnight, at(6, 1, 0), true, at(6, 2, 0)},
+		{"overnight, at end", overnight, at(6, 2, 0), false, time.Time{}},
+		{"overnight, other day", overnight, at(6, 23, 0), false, time.Time{}},
+		{"office, monday", office, at(5, 10, 0), true, at(5, 17, 0)},
+		{"office, tuesday", office, at(6, 16, 59), true, at(6, 17, 0)},
+		{"office, wednesday", office, at(7, 10, 0), false, time.Time{}},
+		{"daily", daily, at(10, 12, 30), true, at(10, 13, 0)},
+		{"daily, outside", daily, at(10, 13, 30), false, time.Time{}},
+	} {
+		end, in := test.window.endOf(test.t)
+		if in != test.in || !end.Equal(test.end) {
+			t.Errorf("%s: endOf = %v, %v; want %v, %v", test.name, end, in, test.end, test.in)
+		}
+	}
+
+	for _, window := range []TimeWindow{
+		{Start: "9:00", End: "25:00"},
+		{Start: "09:00", End: "17:00", Days: []string{"Someday"}},
+		{Start: "09:00", End: "17:00", Location: "Nowhere/Special"},
+	} {
+		if window.validate() == nil {
+			t.Errorf("expected %+v to be invalid", window)
+		}
+	}
+
+	perms := Permissions{Windows: []TimeWindow{overnight, office}, NotAfter: at(6, 12, 0)}
+	for _, test := range []struct {
+		t     time.Time
+		valid bool
+		until time.Time
+	}{
+		{at(5, 10, 0), true, at(5, 17, 0)},
+		{at(5, 23, 0), true, at(6, 2, 0)},
+		// the key expires before the window ends
+		{at(6, 11, 0), true, at(6, 12, 0)},
+		{at(6, 12, 0), false, time.Time{}},
+		{at(5, 18, 0), false, time.Time{}},
+	} {
+		err := perms.checkValidAt(test.t)
+		if (err == nil) != test.valid {
+			t.Errorf("checkValidAt(%v) = %v, want valid=%v", test.t, err, test.valid)
+			continue
+		}
+		if test.valid {
+			if until := perms.validUntil(test.t); !until.Equal(test.until) {
+				t.Errorf("validUntil(%v) = %v, want %v", test.t, until, test.until)
+			}
+		}
+	}
+}
@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -30,45 +32,77 @@ type proxyServer struct {
 
 	// app configuration
 	runningApps    map[string]*appServer
+	appsLock       sync.Mutex
 	portRangeStart int
-	usedPorts      map[string]int
-	portLock       sync.Mutex
+	portRangeSize  int
+	// ports of running apps
+	usedPorts map[string]int
+	portLock  sync.Mutex
+	// if true, apps are served on the proxy server's port instead of their own
+	sharedPort bool
+	// domain under which apps are served in shared port mode, e.g. demo.bw.local
+	appDomain string
 
 	router   *httprouter.Router
 	registry *registry
+
+	// admin server configuration
+	adminCredential string
+	adminRouter     *httprouter.Router
+	// per-key rate limits and quotas
+	usage *usageTracker
+	// bytes each app may keep in its storage
+	storageQuota int64
+	// subscriptions served as Server-Sent Events
+	events *eventHub
+	// calls of a batch that are run at once
+	batchParallelism int
 }
 
 func startProxyServer(cfg *Config) {
 	server := &proxyServer{
-		port:           cfg.Port,
-		useipv6:        cfg.UseIPv6,
-		listenaddress:  cfg.ListenAddress,
-		staticpath:     cfg.StaticPath + "/static",
-		apppath:        cfg.AppPath,
-		runningApps:    make(map[string]*appServer),
-		portRangeStart: cfg.PortRangeStart,
-		usedPorts:      make(map[string]int),
+		port:             cfg.Port,
+		useipv6:          cfg.UseIPv6,
+		listenaddress:    cfg.ListenAddress,
+		staticpath:       cfg.StaticPath + "/static",
+		apppath:          cfg.AppPath,
+		runningApps:      make(map[string]*appServer),
+		portRangeStart:   cfg.PortRangeStart,
+		portRangeSize:    cfg.PortRangeSize,
+		sharedPort:       cfg.SharedPort,
+		appDomain:        strings.ToLower(strings.Trim(cfg.AppDomain, ".")),
+		usedPorts:        make(map[string]int),
+		usage:            newUsageTracker(),
+		storageQuota:     cfg.StorageQuota,
+		events:           newEventHub(),
+		batchParallelism: cfg.BatchParallelism,
+
+		adminCredential: cfg.AdminCredential,
 	}
 	server.router = httprouter.New()
 
 	registryPath := cfg.StaticPath + "/.registry.db"
 	server.registry = newRegistry(registryPath, cfg.BOSSWAVEAgent)
 
+	if cfg.AuditLog != "" {
+		var err error
+		if auditor, err = openAuditLog(cfg.AuditLog, cfg.AuditLogMaxSize); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	server.router.ServeFiles("/static/*filepath", http.Dir(server.staticpath))
 
 	// BW2 API calls
 	server.router.GET("/streaming", server.doStreamingCall)
 	server.router.POST("/call", server.doCall)
+	server.router.GET("/events", server.doEvents)
+	server.router.POST("/events", server.issueEventToken)
+	server.router.POST("/rpc", server.doJSONRPC)
 
-	// app browsing/managemenet
-	server.router.GET("/apps/list", server.listApps)
-	server.router.GET("/apps/start/:name", server.startApp)
-
-	server.router.GET("/", server.phoneHome)
-	server.router.GET("/browse", server.browse)
-	// TODO: think about how to "install" apps. Do we just place the source in a known folder?
+	// app browsing/management lives on the admin server
+	server.startAdminServer(cfg)
 	// TODO: need a way to "isolate" apps: chroot? https://github.com/adtac/fssb? Docker?
-	// TODO: need a way to prevent apps from calling "across" each other
 
 	// configure server
 	var (
@@ -90,89 +124,67 @@ func startProxyServer(cfg *Config) {
 		log.Fatalf("Error resolving address %s (%s)", addrString, err.Error())
 	}
 
-	http.Handle("/", server.router)
+	http.Handle("/", http.HandlerFunc(server.dispatch))
 	log.Notice("Starting HTTP Server on ", addrString)
 
 	srv := &http.Server{
-		Addr: address.String(),
+		Addr:              address.String(),
+		ReadHeaderTimeout: requestHeaderTimeout,
+		ReadTimeout:       requestReadTimeout,
+		IdleTimeout:       idleTimeout,
 	}
 	log.Fatal(srv.ListenAndServe())
 }
 
-// get the key from the request, fetch the permissions from the registry
-func (srv *proxyServer) doStreamingCall(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
-	var rpc_params BWRPCCall
-
-	ctx := req.Context()
+// limits on reading requests and on idle keep-alive connections. There is no write
+// timeout, as /streaming and /events keep their responses open
+const (
+	requestHeaderTimeout = 10 * time.Second
+	requestReadTimeout   = 30 * time.Second
+	idleTimeout          = 2 * time.Minute
+)
 
-	c, err := upgrader.Upgrade(rw, req, nil)
-	if err != nil {
-		log.Error(err)
-		rw.WriteHeader(500)
-		rw.Write([]byte(err.Error()))
-		return
-	}
-	defer c.Close()
-	for {
-		// fetch the RPC params
-		if err := c.ReadJSON(&rpc_params); err != nil {
-			log.Error(err)
-			rw.WriteHeader(400)
-			rw.Write([]byte(err.Error()))
-			return
+// returns the permissions for the API key. Requests made through an app's own host or
+// port without a key are authorized with the key granted to that app. Apps served by
+// path prefix share an origin, so any app's pages could make such requests to any
+// other app: there, a key is always required
+func (srv *proxyServer) authorize(ctx context.Context, key string) (Permissions, error) {
+	if key != "" {
+		perms, err := srv.registry.getPermissions(key)
+		if err != nil {
+			return perms, newRPCError(codeUnauthorized, err)
 		}
-
-		if rpc_params.Key == "" {
-			log.Error("Empty api key!")
-			rw.WriteHeader(400)
-			rw.Write([]byte("Empty API key in request"))
-			return
+		return perms, nil
+	}
+	if app := appFromContext(ctx); app != "" {
+		if prefix := appPrefixFromContext(ctx); prefix != "" {
+			return Permissions{}, rpcErrorf(codeForbidden, "Requests under %s must carry a key issued to app %s; serve apps by host (AppDomain) to use their grant without one", prefix, app)
 		}
-
-		permissions, err := srv.registry.getPermissions(rpc_params.Key)
+		perms, err := srv.registry.getAppPermissions(app)
 		if err != nil {
-			log.Error(err)
-			rw.WriteHeader(500)
-			rw.Write([]byte(err.Error()))
-			return
+			return perms, newRPCError(codeUnauthorized, err)
 		}
+		return perms, nil
+	}
+	return Permissions{}, rpcErrorf(codeUnauthorized, "Empty API key in request")
+}
 
-		log.Debugf("%+v", permissions)
-		log.Debugf("%+v", rpc_params)
-
-		// get the client for the vk
-		client := srv.registry.getClientForVK(permissions.VK)
-		if client == nil {
-			log.Error("No associated client for that VK")
-			rw.WriteHeader(500)
-			rw.Write([]byte("No associated client for that VK"))
-			return
-		}
+// returns the key sent as a bearer token (Authorization: Bearer <key>), or ""
+func bearerKey(req *http.Request) string {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
 
-		respchan, errchan := doRPCStream(ctx, client, permissions, rpc_params)
-		for {
-			select {
-			case <-ctx.Done():
-				err := ctx.Err()
-				log.Error(err)
-				rw.WriteHeader(500)
-				rw.Write([]byte(err.Error()))
-				return
-			case err := <-errchan:
-				log.Error(err)
-				rw.WriteHeader(500)
-				rw.Write([]byte(err.Error()))
-				return
-			case resp := <-respchan:
-				if err := c.WriteMessage(websocket.TextMessage, resp); err != nil {
-					log.Error(err)
-					rw.WriteHeader(500)
-					rw.Write([]byte(err.Error()))
-					return
-				}
-			}
-		}
+// requests made through an app may only use keys issued to that app, so apps cannot
+// act with each other's permissions
+func checkAppKey(ctx context.Context, perms Permissions) error {
+	app := appFromContext(ctx)
+	if app == "" || perms.App == app {
+		return nil
 	}
+	return rpcErrorf(codeForbidden, "Key %s was not issued to app %s", perms.ID, app)
 }
 
 // get the key from the request, fetch the permissions from the registry
@@ -185,55 +197,76 @@ func (srv *proxyServer) doCall(rw http.ResponseWriter, req *http.Request, ps htt
 	rw.Header().Set("Content-Type", "application/json")
 
 	defer req.Body.Close()
-	dec := json.NewDecoder(req.Body)
+	var body json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		writeRPCError(rw, newRPCError(codeBadRequest, err))
+		return
+	}
+	if isBatch(body) {
+		srv.doBatchCall(rw, req, body)
+		return
+	}
 
 	// fetch the RPC params
-	if err := dec.Decode(&rpc_params); err != nil {
-		log.Error(err)
-		rw.WriteHeader(400)
-		rw.Write([]byte(err.Error()))
+	if err := json.Unmarshal(body, &rpc_params); err != nil {
+		writeRPCError(rw, newRPCError(codeBadRequest, err))
 		return
 	}
 
-	if rpc_params.Key == "" {
-		log.Error("Empty api key!")
-		rw.WriteHeader(400)
-		rw.Write([]byte("Empty API key in request"))
+	results, permissions, err := srv.runCall(ctx, rpc_params)
+	if permissions.ID != "" {
+		srv.usage.setHeaders(rw, permissions)
+	}
+	if err != nil {
+		writeRPCError(rw, err)
 		return
 	}
 
+	rw.Write(results)
+	return
+}
+
+// Authorizes and runs a single call, enforcing the key's limits and quotas. Returns
+// the results, the permissions of the key (once it has been authorized) and any error
+func (srv *proxyServer) runCall(ctx context.Context, rpc_params BWRPCCall) ([]byte, Permissions, error) {
 	// get permissions for the key (and the vk)
-	permissions, err := srv.registry.getPermissions(rpc_params.Key)
+	permissions, err := srv.authorize(ctx, rpc_params.Key)
 	if err != nil {
-		log.Error(err)
-		rw.WriteHeader(500)
-		rw.Write([]byte(err.Error()))
-		return
+		return nil, Permissions{}, err
+	}
+	if err := checkAppKey(ctx, permissions); err != nil {
+		return nil, Permissions{}, err
 	}
-
-	log.Debugf("%+v", permissions)
-	log.Debugf("%+v", rpc_params)
 
 	// get the client for the vk
 	client := srv.registry.getClientForVK(permissions.VK)
 	if client == nil {
-		log.Error("No associated client for that VK")
-		rw.WriteHeader(500)
-		rw.Write([]byte("No associated client for that VK"))
-		return
+		return nil, permissions, noClientError()
+	}
+
+	// enforce rate limits and quotas
+	if err := srv.usage.takeCall(permissions); err != nil {
+		auditor.record(ctx, permissions, rpc_params, time.Now(), auditOutcome(err), err)
+		return nil, permissions, err
+	}
+	var publishBytes int64
+	if rpc_params.Proc == PUBLISH {
+		if publishBytes, err = publishSize(rpc_params); err != nil {
+			return nil, permissions, err
+		}
+		if err := srv.usage.reservePublish(permissions, publishBytes); err != nil {
+			auditor.record(ctx, permissions, rpc_params, time.Now(), auditOutcome(err), err)
+			return nil, permissions, err
+		}
 	}
 
 	// do the call and get the results
 	results, err := doRPCCall(ctx, client, permissions, rpc_params)
 	if err != nil {
-		log.Error(err)
-		rw.WriteHeader(500)
-		rw.Write([]byte(err.Error()))
-		return
+		srv.usage.refundPublish(permissions, publishBytes)
+		return nil, permissions, err
 	}
-
-	rw.Write(results)
-	return
+	return results, permissions, nil
 }
 
 func (srv *proxyServer) phoneHome(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
@@ -247,38 +280,46 @@ func (srv *proxyServer) browse(rw http.ResponseWriter, req *http.Request, ps htt
 	http.ServeFile(rw, req, srv.staticpath+"/browse.html")
 }
 
-//TODO: if already started, attach the port number. If not, then render the app start
+// an installed app, as reported by /apps/list
+type appListing struct {
+	appManifest
+	// directory the app is installed in, relative to AppPath
+	Directory string
+	// problems with the app's manifest; apps with errors cannot be started
+	Errors []string `json:",omitempty"`
+}
+
+// lists the installed apps. Apps with a missing or invalid manifest are still listed,
+// along with what is wrong with them
 func (srv *proxyServer) listApps(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	defer req.Body.Close()
 
-	var manifests []appManifest
+	listings := []appListing{}
 
 	// list apps
 	appManifests, _ := filepath.Glob(srv.apppath + "/*/manifest.json")
 	for _, manifestpath := range appManifests {
-		file, err := os.Open(manifestpath)
-		if err != nil {
-			log.Error(errors.Wrapf(err, "Could not load manifest %s", manifestpath))
-			rw.WriteHeader(500)
-			rw.Write([]byte(err.Error()))
-			return
+		dir := filepath.Dir(manifestpath)
+		listing := appListing{Directory: filepath.Base(dir)}
+		manifest, errs := loadAppManifest(dir)
+		for _, err := range errs {
+			log.Error(errors.Wrapf(err, "App %s", listing.Directory))
+			listing.Errors = append(listing.Errors, err.Error())
 		}
-		var manifest appManifest
-		if err := json.NewDecoder(file).Decode(&manifest); err != nil {
-			log.Error(errors.Wrapf(err, "Could not decode manifest %s", manifestpath))
-			rw.WriteHeader(500)
-			rw.Write([]byte(err.Error()))
-			return
+		if manifest.Name == "" {
+			manifest.Name = listing.Directory
 		}
-		if app, found := srv.runningApps[manifest.Name]; found {
-			manifest.Address = srv.listenaddress + ":" + app.port
-		} else {
-			manifest.Address = srv.listenaddress + ":" + srv.port + "/apps/start/" + manifest.Name
+		srv.appsLock.Lock()
+		app, found := srv.runningApps[listing.Directory]
+		srv.appsLock.Unlock()
+		if found {
+			manifest.Address = srv.appAddress(app)
 		}
-		manifests = append(manifests, manifest)
+		listing.appManifest = manifest
+		listings = append(listings, listing)
 	}
 
-	err := json.NewEncoder(rw).Encode(manifests)
+	err := json.NewEncoder(rw).Encode(listings)
 	if err != nil {
 		log.Error(errors.Wrap(err, "Could not write manifest response"))
 		rw.WriteHeader(500)
@@ -291,61 +332,291 @@ func (srv *proxyServer) listApps(rw http.ResponseWriter, req *http.Request, ps h
 func (srv *proxyServer) startApp(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 	defer req.Body.Close()
 
-	appname := ps.ByName("name")
-	if appname == "" || badPathMatch.MatchString(appname) {
-		err := "Could not open app with invalid name " + appname
-		log.Error(err)
-		rw.WriteHeader(500)
-		rw.Write([]byte(err))
-		return
-	}
-	file, err := os.Open(srv.apppath + "/" + appname + "/manifest.json")
+	app, err := srv.launchApp(ps.ByName("name"))
 	if err != nil {
-		err = errors.Wrapf(err, "Could not open manifest for app %s", appname)
 		log.Error(err)
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
-	var manifest appManifest
-	if err := json.NewDecoder(file).Decode(&manifest); err != nil {
-		log.Error(errors.Wrapf(err, "Could not decode manifest %s", srv.apppath+"/"+appname+"/manifest.json"))
-		rw.WriteHeader(500)
-		rw.Write([]byte(err.Error()))
-		return
+
+	// now redirect to the running app
+	http.Redirect(rw, req, "http://"+srv.appAddress(app), http.StatusSeeOther)
+	return
+}
+
+// starts the named app if it is not already running and returns its server
+func (srv *proxyServer) launchApp(appname string) (*appServer, error) {
+	if appname == "" || badPathMatch.MatchString(appname) {
+		return nil, errors.New("Could not open app with invalid name " + appname)
+	}
+
+	srv.appsLock.Lock()
+	defer srv.appsLock.Unlock()
+	if app, found := srv.runningApps[appname]; found {
+		return app, nil
+	}
+
+	manifest, errs := loadAppManifest(srv.apppath + "/" + appname)
+	if len(errs) > 0 {
+		return nil, errors.Wrapf(combineErrors(errs), "Invalid manifest for app %s", appname)
+	}
+
+	if srv.sharedPort {
+		app := newAppServer(&appConfig{
+			name:     appname,
+			port:     srv.port,
+			root:     srv.apppath + "/" + appname,
+			manifest: manifest,
+			proxy:    srv,
+		})
+		log.Notice("Starting", manifest, "at", srv.appAddress(app))
+		srv.runningApps[appname] = app
+		return app, nil
 	}
 
+	port, err := srv.getFreePort(appname)
+	if err != nil {
+		return nil, err
+	}
 	cfg := &appConfig{
-		port:          srv.getFreePort(manifest.Name),
+		name:          appname,
+		port:          port,
 		useipv6:       srv.useipv6,
 		listenaddress: srv.listenaddress,
 		root:          srv.apppath + "/" + appname,
+		manifest:      manifest,
 		proxy:         srv,
 	}
 	log.Notice("Starting", manifest, "on", cfg.port)
 	log.Noticef("%+v", cfg)
-	app := startAppServer(cfg)
+	app, err := startAppServer(cfg)
+	if err != nil {
+		srv.releasePort(appname)
+		return nil, err
+	}
 	srv.runningApps[appname] = app
+	return app, nil
+}
 
-	// now redirect to the running app
-	http.Redirect(rw, req, "http://"+cfg.listenaddress+":"+cfg.port, http.StatusFound)
-	return
+// returns the address (host:port and path) the app is reachable at
+func (srv *proxyServer) appAddress(app *appServer) string {
+	if srv.sharedPort {
+		return srv.listenaddress + ":" + srv.port + "/a/" + app.name + "/"
+	}
+	return srv.listenaddress + ":" + app.port
 }
 
-// gets an open port number for the given application
-func (srv *proxyServer) getFreePort(name string) string {
-	srv.portLock.Lock()
-	defer srv.portLock.Unlock()
-	var newport int
-	for newport = srv.portRangeStart; newport-srv.portRangeStart < 100; newport++ {
-		for _, port := range srv.usedPorts {
-			if port == newport {
+// Handles all requests to the proxy server's port. In shared port mode, requests for
+// <hostname>.<AppDomain> (the app's manifest Hostname, or its name) or under /a/<app>/
+// are passed to that app's router; everything else goes to the proxy server's router
+func (srv *proxyServer) dispatch(rw http.ResponseWriter, req *http.Request) {
+	if !srv.sharedPort {
+		srv.router.ServeHTTP(rw, req)
+		return
+	}
+
+	// dispatch by host
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	if srv.appDomain != "" && strings.HasSuffix(host, "."+srv.appDomain) {
+		srv.serveApp(srv.appForHostname(strings.TrimSuffix(host, "."+srv.appDomain)), rw, req)
+		return
+	}
+
+	// dispatch by path prefix
+	if strings.HasPrefix(req.URL.Path, "/a/") {
+		rest := strings.TrimPrefix(req.URL.Path, "/a/")
+		parts := strings.SplitN(rest, "/", 2)
+		if len(parts) == 1 {
+			// relative URLs in the app only work with a trailing slash
+			http.Redirect(rw, req, "/a/"+parts[0]+"/", http.StatusMovedPermanently)
+			return
+		}
+		r := req.WithContext(context.WithValue(req.Context(), appPrefixContextKey{}, "/a/"+parts[0]+"/"))
+		r.URL = new(url.URL)
+		*r.URL = *req.URL
+		r.URL.Path = "/" + parts[1]
+		r.URL.RawPath = ""
+		srv.serveApp(parts[0], rw, r)
+		return
+	}
+
+	srv.router.ServeHTTP(rw, req)
+}
+
+// returns the name of the running app served under the hostname. Hostnames are
+// case-insensitive, so this may differ in case from the hostname
+func (srv *proxyServer) appForHostname(hostname string) string {
+	srv.appsLock.Lock()
+	defer srv.appsLock.Unlock()
+	for name, app := range srv.runningApps {
+		if strings.EqualFold(app.manifest.hostname(), hostname) {
+			return name
+		}
+	}
+	return hostname
+}
+
+// serves the request with the named app. Names in hosts and URLs are matched
+// case-insensitively, since hostnames are lowercased
+func (srv *proxyServer) serveApp(appname string, rw http.ResponseWriter, req *http.Request) {
+	srv.appsLock.Lock()
+	app, found := srv.runningApps[appname]
+	if !found {
+		for name, running := range srv.runningApps {
+			if strings.EqualFold(name, appname) {
+				app, found = running, true
 				break
 			}
 		}
-		break
 	}
-	srv.usedPorts[name] = newport
-	log.Debug(newport, srv.portRangeStart)
-	return strconv.Itoa(newport)
+	srv.appsLock.Unlock()
+	if !found {
+		rw.WriteHeader(404)
+		rw.Write([]byte("App " + appname + " is not running"))
+		return
+	}
+	app.router.ServeHTTP(rw, req)
+}
+
+// stops the named app: its server is shut down, open subscriptions are closed and its
+// port is released
+func (srv *proxyServer) stopApp(appname string) error {
+	srv.appsLock.Lock()
+	app, found := srv.runningApps[appname]
+	delete(srv.runningApps, appname)
+	srv.appsLock.Unlock()
+	if !found {
+		return errors.Errorf("App %s is not running", appname)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := app.stop(ctx)
+	srv.releasePort(appname)
+	return err
+}
+
+func (srv *proxyServer) restartApp(appname string) (*appServer, error) {
+	if err := srv.stopApp(appname); err != nil {
+		return nil, err
+	}
+	return srv.launchApp(appname)
+}
+
+// stops the named app (if running), removes its directory and revokes the keys
+// bound to it
+func (srv *proxyServer) uninstallApp(appname string) error {
+	if appname == "" || badPathMatch.MatchString(appname) {
+		return errors.New("Invalid app name " + appname)
+	}
+	appdir := srv.apppath + "/" + appname
+	if _, err := os.Stat(appdir + "/manifest.json"); err != nil {
+		return errors.Errorf("App %s is not installed", appname)
+	}
+
+	srv.appsLock.Lock()
+	_, running := srv.runningApps[appname]
+	srv.appsLock.Unlock()
+	if running {
+		if err := srv.stopApp(appname); err != nil {
+			log.Error(errors.Wrapf(err, "Could not cleanly stop %s", appname))
+		}
+	}
+
+	if err := os.RemoveAll(appdir); err != nil {
+		return errors.Wrapf(err, "Could not remove %s", appdir)
+	}
+	if err := srv.registry.removeAppPort(appname); err != nil {
+		log.Error(err)
+	}
+	if err := srv.registry.removeAppGrant(appname); err != nil {
+		log.Error(err)
+	}
+	if err := srv.registry.removeAppConfig(appname); err != nil {
+		log.Error(err)
+	}
+	if err := srv.registry.removeStorage(appname); err != nil {
+		log.Error(err)
+	}
+	revoked, err := srv.registry.revokeKeysForApp(appname)
+	for _, id := range revoked {
+		log.Noticef("Revoked key %s bound to app %s", id, appname)
+	}
+	return err
+}
+
+// gets an open port number for the given application. An app keeps the port it was
+// first assigned (persisted in the registry) across restarts, as long as that port is
+// still free. Otherwise the first port in the range that is neither assigned to another
+// app nor bound by another process is used. Returns an error if the range is exhausted
+func (srv *proxyServer) getFreePort(name string) (string, error) {
+	srv.portLock.Lock()
+	defer srv.portLock.Unlock()
+
+	assigned, err := srv.registry.getAppPorts()
+	if err != nil {
+		return "", err
+	}
+	inUse := make(map[int]bool)
+	for _, port := range srv.usedPorts {
+		inUse[port] = true
+	}
+
+	if port, found := assigned[name]; found && srv.inPortRange(port) && !inUse[port] {
+		if srv.portAvailable(port) {
+			srv.usedPorts[name] = port
+			return strconv.Itoa(port), nil
+		}
+		log.Warningf("Port %d assigned to %s is in use by another process; reassigning", port, name)
+	}
+
+	reserved := make(map[int]bool)
+	for app, port := range assigned {
+		if app != name {
+			reserved[port] = true
+		}
+	}
+	for port := srv.portRangeStart; srv.inPortRange(port); port++ {
+		if inUse[port] || reserved[port] || !srv.portAvailable(port) {
+			continue
+		}
+		if err := srv.registry.setAppPort(name, port); err != nil {
+			return "", err
+		}
+		srv.usedPorts[name] = port
+		log.Debug(port, srv.portRangeStart)
+		return strconv.Itoa(port), nil
+	}
+	return "", errors.Errorf("No free ports left in range %d-%d", srv.portRangeStart, srv.portRangeStart+srv.portRangeSize-1)
+}
+
+func (srv *proxyServer) inPortRange(port int) bool {
+	return port >= srv.portRangeStart && port < srv.portRangeStart+srv.portRangeSize
+}
+
+// checks that the port can be bound by trying to listen on it
+func (srv *proxyServer) portAvailable(port int) bool {
+	nettype := "tcp4"
+	if srv.useipv6 {
+		nettype = "tcp6"
+	}
+	listener, err := net.Listen(nettype, net.JoinHostPort(srv.listenaddress, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// releases the port used by the given application. The app keeps its assignment so it
+// gets the same port when it is started again
+func (srv *proxyServer) releasePort(name string) {
+	srv.portLock.Lock()
+	defer srv.portLock.Unlock()
+	delete(srv.usedPorts, name)
 }
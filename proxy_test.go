@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// returns a shared port proxy serving apps a and b by path prefix, each granted
+// permissions, and keys issued to each app
+func newTestProxy(t *testing.T) (srv *proxyServer, keyA, keyB string) {
+	dir := t.TempDir()
+	srv = &proxyServer{
+		port:        "2222",
+		apppath:     dir,
+		runningApps: make(map[string]*appServer),
+		sharedPort:  true,
+		registry:    newRegistry(filepath.Join(dir, ".registry.db"), ""),
+		usage:       newUsageTracker(),
+		events:      newEventHub(),
+	}
+	t.Cleanup(func() { srv.registry.db.Close() })
+	keys := map[string]string{"a": "key-for-app-a", "b": "key-for-app-b"}
+	for name, key := range keys {
+		perms := Permissions{App: name, Query: QueryPermission{Allowed: true}}
+		if _, err := srv.registry.grantApp(name, perms); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.registry.addPermissions(key, perms); err != nil {
+			t.Fatal(err)
+		}
+		srv.runningApps[name] = newAppServer(&appConfig{
+			name:  name,
+			port:  srv.port,
+			root:  filepath.Join(dir, name),
+			proxy: srv,
+		})
+	}
+	return srv, keys["a"], keys["b"]
+}
+
+// app a's page (same origin as every app under /a/) must not reach app b
+func TestCrossAppRequests(t *testing.T) {
+	srv, keyA, keyB := newTestProxy(t)
+	call := `{"proc": "query", "params": {"uri": "scratch.ns/b"}}`
+	withKey := func(key string) string {
+		return `{"key": "` + key + `", "proc": "query", "params": {"uri": "scratch.ns/b"}}`
+	}
+
+	for _, test := range []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		bearer string
+		status int
+	}{
+		{"call without key", "POST", "/a/b/call", call, "", 403},
+		{"call with key of other app", "POST", "/a/b/call", withKey(keyA), "", 403},
+		{"batch without key", "POST", "/a/b/call", "[" + call + "]", "", 200},
+		{"events without key", "GET", "/a/b/events?uri=scratch.ns/b", "", "", 403},
+		{"config without key", "GET", "/a/b/config", "", "", 403},
+		{"config with key of other app", "GET", "/a/b/config", "", keyA, 403},
+		{"storage without key", "GET", "/a/b/storage", "", "", 403},
+		{"storage put without key", "PUT", "/a/b/storage/x", "1", "", 403},
+		{"storage with key of other app", "GET", "/a/b/storage", "", keyA, 403},
+		{"storage with own key", "GET", "/a/b/storage", "", keyB, 200},
+		{"config with own key", "GET", "/a/b/config", "", keyB, 200},
+	} {
+		req := httptest.NewRequest(test.method, "http://localhost:2222"+test.path, strings.NewReader(test.body))
+		req.Header.Set("Origin", "http://localhost:2222")
+		req.Header.Set("Referer", "http://localhost:2222/a/a/index.html")
+		if test.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+test.bearer)
+		}
+		rw := httptest.NewRecorder()
+		srv.dispatch(rw, req)
+		if rw.Code != test.status {
+			t.Errorf("%s: got status %d, want %d (%s)", test.name, rw.Code, test.status, rw.Body.String())
+		}
+		// each call of a batch fails on its own
+		if test.status == http.StatusOK && strings.HasPrefix(test.body, "[") && !strings.Contains(rw.Body.String(), `"forbidden"`) {
+			t.Errorf("%s: expected forbidden result, got %s", test.name, rw.Body.String())
+		}
+	}
+
+	// served by host, each app has its own origin and uses its grant without a key
+	srv.appDomain = "bw.local"
+	req := httptest.NewRequest("GET", "http://b.bw.local:2222/config", nil)
+	rw := httptest.NewRecorder()
+	srv.dispatch(rw, req)
+	if rw.Code != http.StatusOK {
+		t.Errorf("config by host: got status %d, want 200 (%s)", rw.Code, rw.Body.String())
+	}
+	req = httptest.NewRequest("GET", "http://b.bw.local:2222/config", nil)
+	req.Header.Set("Origin", "http://a.bw.local:2222")
+	rw = httptest.NewRecorder()
+	srv.dispatch(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("config by host from other app: got status %d, want 403", rw.Code)
+	}
+}
+
+// hostnames are lowercased, so apps are found whatever the case of their name
+func TestServeAppIgnoresCase(t *testing.T) {
+	srv, _, _ := newTestProxy(t)
+	srv.appDomain = "bw.local"
+	srv.runningApps["Demo"] = newAppServer(&appConfig{
+		name:     "Demo",
+		port:     srv.port,
+		root:     t.TempDir(),
+		manifest: appManifest{Name: "Demo"},
+		proxy:    srv,
+	})
+	for _, url := range []string{
+		"http://Demo.bw.local:2222/config",
+		"http://demo.bw.local:2222/config",
+		"http://localhost:2222/a/demo/storage?prefix=x",
+	} {
+		req := httptest.NewRequest("GET", url, nil)
+		rw := httptest.NewRecorder()
+		srv.dispatch(rw, req)
+		if rw.Code == http.StatusNotFound {
+			t.Errorf("%s: app not found (%s)", url, rw.Body.String())
+		}
+	}
+}
+
+// requests through an app must be sent to the app's own address, not to a domain
+// rebound to it
+func TestAppRequestHost(t *testing.T) {
+	srv, _, keyB := newTestProxy(t)
+	srv.sharedPort = false
+	app := newAppServer(&appConfig{name: "b", port: "8000", root: t.TempDir(), proxy: srv})
+	for _, test := range []struct {
+		host   string
+		status int
+	}{
+		{"127.0.0.1:8000", 200},
+		{"localhost:8000", 200},
+		{"[::1]:8000", 200},
+		{"evil.com:8000", 403},
+		{"127.0.0.1:8001", 403},
+		{"127.0.0.1", 403},
+	} {
+		req := httptest.NewRequest("GET", "http://"+test.host+"/config", nil)
+		req.Header.Set("Origin", "http://"+test.host)
+		rw := httptest.NewRecorder()
+		app.router.ServeHTTP(rw, req)
+		if rw.Code != test.status {
+			t.Errorf("%s: got status %d, want %d (%s)", test.host, rw.Code, test.status, rw.Body.String())
+		}
+	}
+
+	// in shared port mode, by host and by path prefix
+	srv.sharedPort = true
+	srv.appDomain = "bw.local"
+	for _, test := range []struct {
+		url    string
+		status int
+	}{
+		{"http://b.bw.local:2222/config", 200},
+		{"http://B.BW.LOCAL:2222/config", 200},
+		{"http://localhost:2222/a/b/config", 200},
+		{"http://evil.com:2222/a/b/config", 403},
+	} {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("Authorization", "Bearer "+keyB)
+		rw := httptest.NewRecorder()
+		srv.dispatch(rw, req)
+		if rw.Code != test.status {
+			t.Errorf("%s: got status %d, want %d (%s)", test.url, rw.Code, test.status, rw.Body.String())
+		}
+	}
+}
+
+// a key whose entity has no BOSSWAVE client is an upstream failure, not an internal error
+func TestCallWithoutClient(t *testing.T) {
+	srv, keyA, _ := newTestProxy(t)
+	req := httptest.NewRequest("POST", "http://localhost:2222/call", strings.NewReader(`{"key": "`+keyA+`", "proc": "query", "params": {"uri": "scratch.ns/a"}}`))
+	rw := httptest.NewRecorder()
+	srv.doCall(rw, req, nil)
+	if rw.Code != http.StatusBadGateway || !strings.Contains(rw.Body.String(), `"code":"`+codeRouter+`"`) {
+		t.Errorf("got %d %s", rw.Code, rw.Body)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Per-key limits, configured as part of Permissions. A zero value means unlimited
+type Limits struct {
+	// sustained rate of calls (and subscription requests) per second
+	CallsPerSecond float64
+	// maximum number of calls that can be made in a burst; defaults to 1 if
+	// CallsPerSecond is set
+	CallBurst int
+	// maximum number of concurrently open subscriptions
+	MaxSubscriptions int
+	// maximum number of payload bytes that can be published per (UTC) day
+	DailyPublishBytes int64
+}
+
+// returned when a key has exceeded one of its limits
+type limitError struct {
+	msg        string
+	retryAfter time.Duration
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+// current usage for a single key
+type keyUsage struct {
+	// token bucket for calls
+	tokens     float64
+	lastRefill time.Time
+	// number of open subscriptions
+	subscriptions int
+	// bytes published on publishDay
+	publishedBytes int64
+	publishDay     string
+}
+
+// tracks usage for all keys in memory; usage is reset when the proxy restarts
+type usageTracker struct {
+	keys map[string]*keyUsage
+	sync.Mutex
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{
+		keys: make(map[string]*keyUsage),
+	}
+}
+
+// returns the usage for the key. Must be called with the lock held
+func (t *usageTracker) get(perms Permissions) *keyUsage {
+	usage, found := t.keys[perms.ID]
+	if !found {
+		usage = &keyUsage{
+			tokens:     float64(perms.Limits.burst()),
+			lastRefill: time.Now(),
+		}
+		t.keys[perms.ID] = usage
+	}
+	return usage
+}
+
+func (l Limits) burst() int {
+	if l.CallBurst > 0 {
+		return l.CallBurst
+	}
+	return 1
+}
+
+// takes a token from the key's bucket; returns an error if there are none left
+func (t *usageTracker) takeCall(perms Permissions) error {
+	if perms.Limits.CallsPerSecond <= 0 {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	usage := t.get(perms)
+	usage.refill(perms.Limits)
+	if usage.tokens < 1 {
+		wait := time.Duration((1 - usage.tokens) / perms.Limits.CallsPerSecond * float64(time.Second))
+		return &limitError{msg: "Call rate limit exceeded", retryAfter: wait}
+	}
+	usage.tokens -= 1
+	return nil
+}
+
+func (usage *keyUsage) refill(limits Limits) {
+	now := time.Now()
+	usage.tokens += now.Sub(usage.lastRefill).Seconds() * limits.CallsPerSecond
+	usage.tokens = math.Min(usage.tokens, float64(limits.burst()))
+	usage.lastRefill = now
+}
+
+// registers a new subscription for the key; returns an error if the key has too
+// many open. Every successful call must be matched by a call to closeSubscription
+func (t *usageTracker) openSubscription(perms Permissions) error {
+	t.Lock()
+	defer t.Unlock()
+	usage := t.get(perms)
+	if perms.Limits.MaxSubscriptions > 0 && usage.subscriptions >= perms.Limits.MaxSubscriptions {
+		return &limitError{msg: "Too many open subscriptions"}
+	}
+	usage.subscriptions++
+	return nil
+}
+
+func (t *usageTracker) closeSubscription(perms Permissions) {
+	t.Lock()
+	defer t.Unlock()
+	t.get(perms).subscriptions--
+}
+
+// reserves size bytes of the key's daily publish quota
+func (t *usageTracker) reservePublish(perms Permissions, size int64) error {
+	if perms.Limits.DailyPublishBytes <= 0 {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	usage := t.get(perms)
+	usage.resetDay()
+	if usage.publishedBytes+size > perms.Limits.DailyPublishBytes {
+		now := time.Now().UTC()
+		tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return &limitError{msg: "Daily publish quota exceeded", retryAfter: tomorrow.Sub(now)}
+	}
+	usage.publishedBytes += size
+	return nil
+}
+
+// returns bytes reserved for a publish that did not happen
+func (t *usageTracker) refundPublish(perms Permissions, size int64) {
+	if perms.Limits.DailyPublishBytes <= 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	usage := t.get(perms)
+	usage.resetDay()
+	usage.publishedBytes -= size
+	if usage.publishedBytes < 0 {
+		usage.publishedBytes = 0
+	}
+}
+
+func (usage *keyUsage) resetDay() {
+	today := time.Now().UTC().Format("2006-01-02")
+	if usage.publishDay != today {
+		usage.publishDay = today
+		usage.publishedBytes = 0
+	}
+}
+
+// writes the remaining budgets for the key as response headers
+func (t *usageTracker) setHeaders(rw http.ResponseWriter, perms Permissions) {
+	t.Lock()
+	defer t.Unlock()
+	usage := t.get(perms)
+	if perms.Limits.CallsPerSecond > 0 {
+		usage.refill(perms.Limits)
+		rw.Header().Set("X-RateLimit-Limit", strconv.Itoa(perms.Limits.burst()))
+		rw.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(usage.tokens)))
+	}
+	if perms.Limits.DailyPublishBytes > 0 {
+		usage.resetDay()
+		rw.Header().Set("X-Quota-Publish-Bytes-Limit", strconv.FormatInt(perms.Limits.DailyPublishBytes, 10))
+		rw.Header().Set("X-Quota-Publish-Bytes-Remaining", strconv.FormatInt(perms.Limits.DailyPublishBytes-usage.publishedBytes, 10))
+	}
+	if perms.Limits.MaxSubscriptions > 0 {
+		rw.Header().Set("X-Subscriptions-Remaining", strconv.Itoa(perms.Limits.MaxSubscriptions-usage.subscriptions))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		limits Limits
+		// calls made at once, then after waiting
+		calls, allowed int
+		wait           time.Duration
+		// calls allowed after waiting
+		refilled int
+	}{
+		{"unlimited", Limits{}, 50, 50, 0, 50},
+		{"default burst of one", Limits{CallsPerSecond: 1}, 3, 1, time.Second, 1},
+		{"burst", Limits{CallsPerSecond: 2, CallBurst: 5}, 8, 5, time.Second, 2},
+		{"refill is capped at the burst", Limits{CallsPerSecond: 10, CallBurst: 3}, 3, 3, time.Minute, 3},
+		{"partial refill", Limits{CallsPerSecond: 1, CallBurst: 4}, 4, 4, 1500 * time.Millisecond, 1},
+	} {
+		tracker := newUsageTracker()
+		perms := Permissions{ID: "key", Limits: test.limits}
+
+		allowed := 0
+		for i := 0; i < test.calls; i++ {
+			if err := tracker.takeCall(perms); err == nil {
+				allowed++
+			} else if retry := asRPCError(err).Details["retry_after"]; retry == nil {
+				t.Errorf("%s: limit error without retry_after: %v", test.name, err)
+			}
+		}
+		if allowed != test.allowed {
+			t.Errorf("%s: %d of %d calls allowed, want %d", test.name, allowed, test.calls, test.allowed)
+		}
+
+		// pretend time has passed
+		tracker.Lock()
+		tracker.get(perms).lastRefill = tracker.get(perms).lastRefill.Add(-test.wait)
+		tracker.Unlock()
+		refilled := 0
+		for i := 0; i < test.calls; i++ {
+			if tracker.takeCall(perms) == nil {
+				refilled++
+			}
+		}
+		if refilled != test.refilled {
+			t.Errorf("%s: %d calls allowed after %v, want %d", test.name, refilled, test.wait, test.refilled)
+		}
+	}
+}
+
+func TestSubscriptionAndPublishLimits(t *testing.T) {
+	tracker := newUsageTracker()
+	perms := Permissions{ID: "key", Limits: Limits{MaxSubscriptions: 2, DailyPublishBytes: 100}}
+
+	for i, want := range []bool{true, true, false} {
+		if err := tracker.openSubscription(perms); (err == nil) != want {
+			t.Errorf("subscription %d: %v, want allowed=%v", i, err, want)
+		}
+	}
+	tracker.closeSubscription(perms)
+	if err := tracker.openSubscription(perms); err != nil {
+		t.Errorf("subscription after close: %v", err)
+	}
+
+	for _, test := range []struct {
+		size    int64
+		allowed bool
+	}{
+		{60, true},
+		{50, false},
+		{40, true},
+		{1, false},
+	} {
+		if err := tracker.reservePublish(perms, test.size); (err == nil) != test.allowed {
+			t.Errorf("publish of %d bytes: %v, want allowed=%v", test.size, err, test.allowed)
+		}
+	}
+	tracker.refundPublish(perms, 40)
+	if err := tracker.reservePublish(perms, 40); err != nil {
+		t.Errorf("publish after refund: %v", err)
+	}
+}
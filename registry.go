@@ -1,8 +1,10 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,6 +16,9 @@ import (
 
 var entityBucket = []byte("entity")
 var permissionsBucket = []byte("permissions")
+var portsBucket = []byte("ports")
+var appKeysBucket = []byte("appkeys")
+var appConfigBucket = []byte("appconfig")
 
 // stores our entities and allows us to pull the BW2Clients using the VKs
 type registry struct {
@@ -45,9 +50,18 @@ func newRegistry(filename, agent string) *registry {
 	s.db.Update(func(tx *bolt.Tx) error {
 		tx.CreateBucket(entityBucket)
 		tx.CreateBucket(permissionsBucket)
+		tx.CreateBucket(portsBucket)
+		tx.CreateBucket(appKeysBucket)
+		tx.CreateBucket(appConfigBucket)
+		tx.CreateBucket(storageBucket)
+		tx.CreateBucket(storageUsageBucket)
 		return nil
 	})
 
+	if err := s.migrateKeys(); err != nil {
+		log.Fatal(errors.Wrap(err, "Could not migrate API keys"))
+	}
+
 	s.scanAndLoadVKs()
 	s.dbLock.Lock()
 	defer s.dbLock.Unlock()
@@ -61,25 +75,31 @@ func (s *registry) scanAndLoadVKs() {
 		b := tx.Bucket(entityBucket)
 		// loop through the bucket and create clients for each of the known keys
 		b.ForEach(func(vk, contents []byte) error {
-			client := bw2.ConnectOrExit(s.agent)
-			vk2, err := client.SetEntity(contents)
-			if err != nil {
-				log.Error(errors.Wrap(err, "Could not set entity"))
-				return nil
+			if err := s.loadClient(vk, contents); err != nil {
+				log.Error(err)
 			}
-			vk_string := base64.URLEncoding.EncodeToString(vk)
-			if vk_string != vk2 {
-				log.Error(errors.Wrapf(err, "Retrieved vk %s did not match vk from router %s", vk_string, vk2))
-				return nil
-			}
-			s.clients[vk_string] = client
-			log.Infof("Loaded vk %s", vk_string)
 			return nil
 		})
 		return nil
 	})
 }
 
+// creates a client for the entity. Must be called with the lock held
+func (s *registry) loadClient(vk, contents []byte) error {
+	client := bw2.ConnectOrExit(s.agent)
+	vk2, err := client.SetEntity(contents)
+	if err != nil {
+		return errors.Wrap(err, "Could not set entity")
+	}
+	vk_string := base64.URLEncoding.EncodeToString(vk)
+	if vk_string != vk2 {
+		return errors.Errorf("Retrieved vk %s did not match vk from router %s", vk_string, vk2)
+	}
+	s.clients[vk_string] = client
+	log.Infof("Loaded vk %s", vk_string)
+	return nil
+}
+
 // Add entity from the given bytes. This will probably be loaded using a file browser
 // in the web browser and transmitted
 // The entity contents get stored in the entity bucket with the public key (vk) as the key.
@@ -109,30 +129,460 @@ func (s *registry) addEntityBytes(entityContents []byte) (string, error) {
 	return vk_string, err
 }
 
+// adds the entity and creates a client for it, so it can be used without restarting.
+// Returns the vk of the entity
+func (s *registry) addAndLoadEntity(entityContents []byte) (string, error) {
+	if len(entityContents) < 2 {
+		return "", errors.New("Entity file is too short")
+	}
+	vk, err := s.addEntityBytes(entityContents)
+	if err != nil {
+		return vk, err
+	}
+	vk_bytes, err := base64.URLEncoding.DecodeString(vk)
+	if err != nil {
+		return vk, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	return vk, s.loadClient(vk_bytes, entityContents[1:])
+}
+
+// returns the vks of all stored entities
+func (s *registry) listEntities() ([]string, error) {
+	var vks []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entityBucket)
+		return b.ForEach(func(vk, _ []byte) error {
+			vks = append(vks, base64.URLEncoding.EncodeToString(vk))
+			return nil
+		})
+	})
+	return vks, err
+}
+
+// removes the entity with the given vk. Fails if any API keys still use it
+func (s *registry) removeEntity(vk string) error {
+	vk_bytes, err := base64.URLEncoding.DecodeString(vk)
+	if err != nil {
+		return errors.Wrap(err, "Invalid vk")
+	}
+	perms, err := s.listPermissions()
+	if err != nil {
+		return err
+	}
+	for _, perm := range perms {
+		if perm.VK == vk {
+			return errors.Errorf("Entity is still used by key %s", perm.ID)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(entityBucket)
+		if b.Get(vk_bytes) == nil {
+			return errors.New("No such entity")
+		}
+		return b.Delete(vk_bytes)
+	})
+	if err == nil {
+		delete(s.clients, vk)
+	}
+	return err
+}
+
 func (s *registry) getClientForVK(vk string) *bw2.BW2Client {
 	s.RLock()
 	defer s.RUnlock()
 	return s.clients[vk]
 }
 
+// the permissions bucket stores one record per API key, indexed by the key id.
+// Only a salted hash of the key itself is kept
+type keyRecord struct {
+	Salt        []byte
+	Hash        []byte
+	Permissions Permissions
+}
+
+func (rec keyRecord) matches(key string) bool {
+	return subtle.ConstantTimeCompare(hashAPIKey(rec.Salt, key), rec.Hash) == 1
+}
+
+func getKeyRecord(b *bolt.Bucket, id string) (keyRecord, error) {
+	var rec keyRecord
+	rec_bytes := b.Get([]byte(id))
+	if rec_bytes == nil {
+		return rec, errors.New("No such API key")
+	}
+	if err := json.Unmarshal(rec_bytes, &rec); err != nil {
+		return rec, errors.Wrapf(err, "Could not decode permissions for key %s", id)
+	}
+	rec.Permissions.ID = id
+	return rec, nil
+}
+
+func putKeyRecord(b *bolt.Bucket, id string, rec keyRecord) error {
+	rec.Permissions.ID = id
+	rec_bytes, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(id), rec_bytes)
+}
+
+// rewrites any permissions stored under a raw API key (from before keys were hashed)
+// into a hashed key record
+func (s *registry) migrateKeys() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		var legacy = make(map[string][]byte)
+		err := b.ForEach(func(key, contents []byte) error {
+			var rec keyRecord
+			if err := json.Unmarshal(contents, &rec); err != nil {
+				return errors.Wrapf(err, "Could not decode permissions for key %s", key)
+			}
+			if len(rec.Hash) == 0 {
+				legacy[string(key)] = contents
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for key, contents := range legacy {
+			var perms Permissions
+			if err := json.Unmarshal(contents, &perms); err != nil {
+				return errors.Wrapf(err, "Could not decode permissions for key %s", key)
+			}
+			salt, err := newSalt()
+			if err != nil {
+				return err
+			}
+			id := apiKeyID(key)
+			if err := b.Delete([]byte(key)); err != nil {
+				return err
+			}
+			if err := putKeyRecord(b, id, keyRecord{Salt: salt, Hash: hashAPIKey(salt, key), Permissions: perms}); err != nil {
+				return err
+			}
+			log.Noticef("Migrated API key %s to hashed storage", id)
+		}
+		return nil
+	})
+}
+
+// stores the permissions for the given API key. Only a salted hash of the key is stored
 func (s *registry) addPermissions(key string, perms Permissions) error {
 	s.Lock()
 	defer s.Unlock()
-	permission_bytes, err := json.Marshal(perms)
+	salt, err := newSalt()
 	if err != nil {
 		return err
 	}
+	rec := keyRecord{
+		Salt:        salt,
+		Hash:        hashAPIKey(salt, key),
+		Permissions: perms,
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		return putKeyRecord(b, apiKeyID(key), rec)
+	})
+}
+
+// replaces the permissions for the key with the given id
+func (s *registry) updatePermissions(id string, perms Permissions) error {
+	s.Lock()
+	defer s.Unlock()
 	return s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(permissionsBucket)
-		return b.Put([]byte(key), permission_bytes)
+		rec, err := getKeyRecord(b, id)
+		if err != nil {
+			return err
+		}
+		rec.Permissions = perms
+		return putKeyRecord(b, id, rec)
 	})
 }
 
+// fetches the permissions for the API key. Permissions.Key is set to the provided key
 func (s *registry) getPermissions(key string) (Permissions, error) {
+	var perm Permissions
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		rec, err := getKeyRecord(b, apiKeyID(key))
+		if err != nil {
+			return err
+		}
+		if !rec.matches(key) {
+			return errors.New("No such API key")
+		}
+		perm = rec.Permissions
+		return nil
+	})
+	if err != nil {
+		return perm, err
+	}
+	if err := perm.checkValidAt(time.Now()); err != nil {
+		return perm, err
+	}
+	perm.Key = key
+	return perm, nil
+}
+
+// fetches the permissions for the key with the given id. Permissions.Key is not set
+func (s *registry) getPermissionsByID(id string) (Permissions, error) {
 	var perm Permissions
 	return perm, s.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(permissionsBucket)
-		perm_bytes := b.Get([]byte(key))
-		return json.Unmarshal(perm_bytes, &perm)
+		rec, err := getKeyRecord(b, id)
+		perm = rec.Permissions
+		return err
+	})
+}
+
+// returns the permissions for all registered API keys
+func (s *registry) listPermissions() ([]Permissions, error) {
+	var perms []Permissions
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		return b.ForEach(func(id, _ []byte) error {
+			rec, err := getKeyRecord(b, string(id))
+			if err != nil {
+				return err
+			}
+			perms = append(perms, rec.Permissions)
+			return nil
+		})
+	})
+	return perms, err
+}
+
+// removes the API key with the given id so that it can no longer be used
+func (s *registry) revokeKey(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		if b.Get([]byte(id)) == nil {
+			return errors.New("No such API key")
+		}
+		return b.Delete([]byte(id))
+	})
+}
+
+// revokes all keys bound to the named app and returns their ids
+func (s *registry) revokeKeysForApp(app string) ([]string, error) {
+	perms, err := s.listPermissions()
+	if err != nil {
+		return nil, err
+	}
+	var revoked []string
+	for _, perm := range perms {
+		if perm.App != app {
+			continue
+		}
+		if err := s.revokeKey(perm.ID); err != nil {
+			return revoked, err
+		}
+		revoked = append(revoked, perm.ID)
+	}
+	return revoked, nil
+}
+
+// issues a new API key with the same permissions (and expiry) as the key with the
+// given id. If grace is 0, the old key is revoked immediately; otherwise it keeps
+// working for the duration of the grace period, or until it would have expired
+// anyway if that is sooner. If the old key was granted to an app, the app's grant
+// moves to the new key. Returns the new key
+func (s *registry) rotateKey(id string, grace time.Duration) (string, error) {
+	newkey, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	s.Lock()
+	defer s.Unlock()
+	return newkey, s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		rec, err := getKeyRecord(b, id)
+		if err != nil {
+			return err
+		}
+		newrec := keyRecord{Salt: salt, Hash: hashAPIKey(salt, newkey), Permissions: rec.Permissions}
+		if err := putKeyRecord(b, apiKeyID(newkey), newrec); err != nil {
+			return err
+		}
+
+		if app := rec.Permissions.App; app != "" {
+			appkeys := tx.Bucket(appKeysBucket)
+			if string(appkeys.Get([]byte(app))) == id {
+				if err := appkeys.Put([]byte(app), []byte(apiKeyID(newkey))); err != nil {
+					return err
+				}
+			}
+		}
+
+		if grace == 0 {
+			return b.Delete([]byte(id))
+		}
+		until := time.Now().Add(grace)
+		if rec.Permissions.NotAfter.IsZero() || until.Before(rec.Permissions.NotAfter) {
+			rec.Permissions.NotAfter = until
+		}
+		return putKeyRecord(b, id, rec)
+	})
+}
+
+// returns the ports assigned to each app
+func (s *registry) getAppPorts() (map[string]int, error) {
+	var ports = make(map[string]int)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(portsBucket)
+		return b.ForEach(func(name, port []byte) error {
+			p, err := strconv.Atoi(string(port))
+			if err != nil {
+				return errors.Wrapf(err, "Invalid port for app %s", name)
+			}
+			ports[string(name)] = p
+			return nil
+		})
+	})
+	return ports, err
+}
+
+// records the port assigned to the app
+func (s *registry) setAppPort(name string, port int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(portsBucket)
+		return b.Put([]byte(name), []byte(strconv.Itoa(port)))
+	})
+}
+
+func (s *registry) removeAppPort(name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(portsBucket)
+		return b.Delete([]byte(name))
+	})
+}
+
+// creates a key with the given permissions bound to the app, which requests made
+// through the app are authorized with. The key itself is never returned, so it cannot
+// leak out of the app's pages. Replaces (and revokes) any key previously granted to
+// the app. Returns the id of the new key
+func (s *registry) grantApp(app string, perms Permissions) (string, error) {
+	key, err := newAPIKey()
+	if err != nil {
+		return "", err
+	}
+	perms.App = app
+	if err := s.addPermissions(key, perms); err != nil {
+		return "", err
+	}
+	id := apiKeyID(key)
+
+	var oldID []byte
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(appKeysBucket)
+		oldID = b.Get([]byte(app))
+		if oldID != nil {
+			oldID = append([]byte{}, oldID...)
+		}
+		return b.Put([]byte(app), []byte(id))
+	})
+	if err != nil {
+		return "", err
+	}
+	if oldID != nil {
+		if err := s.revokeKey(string(oldID)); err != nil {
+			log.Warning(errors.Wrapf(err, "Could not revoke previous key for app %s", app))
+		}
+	}
+	return id, nil
+}
+
+// returns the permissions of the key granted to the app
+func (s *registry) getAppPermissions(app string) (Permissions, error) {
+	var id []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		id = tx.Bucket(appKeysBucket).Get([]byte(app))
+		if id != nil {
+			id = append([]byte{}, id...)
+		}
+		return nil
+	})
+	if id == nil {
+		return Permissions{}, errors.Errorf("App %s has not been granted a key", app)
+	}
+	perms, err := s.getPermissionsByID(string(id))
+	if err != nil {
+		return perms, err
+	}
+	return perms, perms.checkValidAt(time.Now())
+}
+
+func (s *registry) removeAppGrant(app string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(appKeysBucket).Delete([]byte(app))
+	})
+}
+
+// returns the config values set for the app
+func (s *registry) getAppConfig(app string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(appConfigBucket).Get([]byte(app))
+		if stored == nil {
+			return nil
+		}
+		return errors.Wrapf(json.Unmarshal(stored, &values), "Invalid config for app %s", app)
+	})
+	return values, err
+}
+
+// changes the stored config values of the app
+func (s *registry) updateAppConfig(app string, update func(values map[string]interface{})) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(appConfigBucket)
+		values := make(map[string]interface{})
+		if stored := b.Get([]byte(app)); stored != nil {
+			if err := json.Unmarshal(stored, &values); err != nil {
+				return errors.Wrapf(err, "Invalid config for app %s", app)
+			}
+		}
+		update(values)
+		if len(values) == 0 {
+			return b.Delete([]byte(app))
+		}
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(app), encoded)
+	})
+}
+
+func (s *registry) setAppConfigValue(app, option string, value interface{}) error {
+	return s.updateAppConfig(app, func(values map[string]interface{}) {
+		values[option] = value
+	})
+}
+
+func (s *registry) unsetAppConfigValue(app, option string) error {
+	return s.updateAppConfig(app, func(values map[string]interface{}) {
+		delete(values, option)
+	})
+}
+
+func (s *registry) removeAppConfig(app string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(appConfigBucket).Delete([]byte(app))
 	})
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func newTestRegistry(t *testing.T) *registry {
+	reg := newRegistry(filepath.Join(t.TempDir(), ".registry.db"), "")
+	t.Cleanup(func() { reg.db.Close() })
+	return reg
+}
+
+func TestKeyLookup(t *testing.T) {
+	reg := newTestRegistry(t)
+	key := "some api key"
+	if err := reg.addPermissions(key, Permissions{VK: "vk", Query: QueryPermission{Allowed: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the salted hash is stored, under the key id
+	reg.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		if b.Get([]byte(key)) != nil {
+			t.Error("raw key stored in the registry")
+		}
+		rec, err := getKeyRecord(b, apiKeyID(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rec.Salt) == 0 || string(rec.Hash) == key || !rec.matches(key) {
+			t.Errorf("bad key record %+v", rec)
+		}
+		return nil
+	})
+
+	for _, test := range []struct {
+		key   string
+		found bool
+	}{
+		{key, true},
+		{key + " ", false},
+		{"", false},
+		{"another key", false},
+	} {
+		perms, err := reg.getPermissions(test.key)
+		if (err == nil) != test.found {
+			t.Errorf("getPermissions(%q) = %v, want found=%v", test.key, err, test.found)
+			continue
+		}
+		if test.found && (perms.ID != apiKeyID(key) || perms.Key != key || perms.VK != "vk") {
+			t.Errorf("getPermissions(%q) = %+v", test.key, perms)
+		}
+	}
+
+	// expired keys are not returned
+	expired := "expired key"
+	reg.addPermissions(expired, Permissions{NotAfter: time.Now().Add(-time.Minute)})
+	if _, err := reg.getPermissions(expired); err == nil {
+		t.Error("expired key was accepted")
+	}
+}
+
+func TestKeyMigration(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, ".registry.db")
+	reg := newRegistry(filename, "")
+	// keys used to be stored raw, with the permissions as the value
+	legacy := map[string]Permissions{
+		"legacy key one": {VK: "vk1", Publish: PublishPermission{Allowed: true}},
+		"legacy key two": {VK: "vk2", App: "demo"},
+	}
+	err := reg.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		for key, perms := range legacy {
+			contents, err := json.Marshal(perms)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), contents); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.db.Close()
+
+	// migrated when the registry is opened
+	reg = newRegistry(filename, "")
+	defer reg.db.Close()
+	for key, want := range legacy {
+		perms, err := reg.getPermissions(key)
+		if err != nil {
+			t.Errorf("%s: %v", key, err)
+			continue
+		}
+		if perms.VK != want.VK || perms.App != want.App || perms.Publish.Allowed != want.Publish.Allowed {
+			t.Errorf("%s: got %+v, want %+v", key, perms, want)
+		}
+	}
+	reg.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(permissionsBucket)
+		for key := range legacy {
+			if b.Get([]byte(key)) != nil {
+				t.Errorf("raw key %s left in the registry", key)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRotateKeyExpiry(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		name     string
+		notAfter time.Time
+		grace    time.Duration
+		// expiry of the old key, relative to now; zero if revoked
+		oldExpiry time.Duration
+	}{
+		{"permanent key", time.Time{}, time.Hour, time.Hour},
+		{"expires after grace", now.Add(2 * time.Hour), time.Hour, time.Hour},
+		{"expires before grace", now.Add(time.Hour), 2 * time.Hour, time.Hour},
+		{"no grace", now.Add(time.Hour), 0, 0},
+	} {
+		reg := newTestRegistry(t)
+		key := "key to rotate"
+		reg.addPermissions(key, Permissions{VK: "vk", NotAfter: test.notAfter})
+		newkey, err := reg.rotateKey(apiKeyID(key), test.grace)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		perms, err := reg.getPermissions(newkey)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !perms.NotAfter.Equal(test.notAfter) {
+			t.Errorf("%s: new key expires at %v, want %v", test.name, perms.NotAfter, test.notAfter)
+		}
+
+		old, err := reg.getPermissionsByID(apiKeyID(key))
+		if test.oldExpiry == 0 {
+			if err == nil {
+				t.Errorf("%s: old key was not revoked", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if d := old.NotAfter.Sub(now.Add(test.oldExpiry)); d < 0 || d > time.Minute {
+			t.Errorf("%s: old key expires at %v, want %v", test.name, old.NotAfter, now.Add(test.oldExpiry))
+		}
+	}
+}
+
+// the app's keyless grant follows its key through a rotation
+func TestRotateAppKey(t *testing.T) {
+	for _, grace := range []time.Duration{0, time.Hour} {
+		reg := newTestRegistry(t)
+		id, err := reg.grantApp("demo", Permissions{VK: "vk", Query: QueryPermission{Allowed: true}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		newkey, err := reg.rotateKey(id, grace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		perms, err := reg.getAppPermissions("demo")
+		if err != nil {
+			t.Errorf("grace %v: %v", grace, err)
+			continue
+		}
+		if perms.ID != apiKeyID(newkey) || perms.App != "demo" || !perms.Query.Allowed {
+			t.Errorf("grace %v: app is granted %+v, want the new key %s", grace, perms, apiKeyID(newkey))
+		}
+
+		// rotating a key of the app that isn't its grant leaves the grant alone
+		other := "another key for demo"
+		reg.addPermissions(other, Permissions{VK: "vk", App: "demo"})
+		if _, err := reg.rotateKey(apiKeyID(other), grace); err != nil {
+			t.Fatal(err)
+		}
+		if perms, _ := reg.getAppPermissions("demo"); perms.ID != apiKeyID(newkey) {
+			t.Errorf("grace %v: grant moved to %s", grace, perms.ID)
+		}
+	}
+}
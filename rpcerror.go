@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+// codes of the errors returned to clients of /call, /streaming and /events
+const (
+	// the request could not be decoded
+	codeBadRequest = "bad_request"
+	// missing, unknown, expired or otherwise invalid API key
+	codeUnauthorized = "unauthorized"
+	// the key does not allow the call
+	codeForbidden = "forbidden"
+	// the procedure or its parameters are invalid
+	codeInvalidParams = "invalid_params"
+	// the key is over one of its limits
+	codeRateLimited = "rate_limited"
+	// the BOSSWAVE router failed the call
+	codeRouter = "router_error"
+	// the call did not complete in time
+	codeTimeout  = "timeout"
+	codeInternal = "internal"
+)
+
+// error returned to clients
+type rpcError struct {
+	Code    string                 `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+	// true if the same call may succeed later
+	Retryable bool `json:"retryable"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func newRPCError(code string, err error) *rpcError {
+	return &rpcError{
+		Code:      code,
+		Message:   err.Error(),
+		Retryable: code == codeRateLimited || code == codeRouter || code == codeTimeout,
+	}
+}
+
+func rpcErrorf(code, format string, args ...interface{}) *rpcError {
+	return newRPCError(code, errors.Errorf(format, args...))
+}
+
+// adds a detail to the error
+func (e *rpcError) with(key string, value interface{}) *rpcError {
+	if e.Details == nil {
+		e.Details = make(map[string]interface{})
+	}
+	e.Details[key] = value
+	return e
+}
+
+// the entity of a key has no BOSSWAVE client, e.g. because the agent could not be
+// reached when the entity was loaded
+func noClientError() *rpcError {
+	return rpcErrorf(codeRouter, "No BOSSWAVE client for the key's entity")
+}
+
+// returns the error as an rpcError; errors without a code are internal errors
+func asRPCError(err error) *rpcError {
+	switch cause := errors.Cause(err).(type) {
+	case *rpcError:
+		return cause
+	case *limitError:
+		rerr := newRPCError(codeRateLimited, err)
+		if cause.retryAfter > 0 {
+			rerr.with("retry_after", int(math.Ceil(cause.retryAfter.Seconds())))
+		}
+		return rerr
+	}
+	if cause := errors.Cause(err); cause == context.DeadlineExceeded || cause == context.Canceled {
+		return newRPCError(codeTimeout, err)
+	}
+	return newRPCError(codeInternal, err)
+}
+
+// HTTP status of the error
+func (e *rpcError) status() int {
+	switch e.Code {
+	case codeBadRequest:
+		return http.StatusBadRequest
+	case codeUnauthorized:
+		return http.StatusUnauthorized
+	case codeForbidden:
+		return http.StatusForbidden
+	case codeInvalidParams:
+		return http.StatusUnprocessableEntity
+	case codeRateLimited:
+		return http.StatusTooManyRequests
+	case codeRouter:
+		return http.StatusBadGateway
+	case codeTimeout:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// websocket close code of the error
+func (e *rpcError) closeCode() int {
+	switch e.Code {
+	case codeUnauthorized, codeForbidden:
+		return websocket.ClosePolicyViolation
+	case codeBadRequest, codeInvalidParams:
+		return websocket.CloseUnsupportedData
+	}
+	if e.Retryable {
+		return websocket.CloseTryAgainLater
+	}
+	return websocket.CloseInternalServerErr
+}
+
+// the reason of a close frame is limited to 123 bytes of UTF-8, so it is cut at the
+// last whole rune that fits
+func (e *rpcError) closeReason() string {
+	reason := e.Code + ": " + e.Message
+	if len(reason) <= 123 {
+		return reason
+	}
+	cut := 123
+	for cut > 0 && !utf8.RuneStart(reason[cut]) {
+		cut--
+	}
+	return reason[:cut]
+}
+
+// writes the error as a JSON response with the matching status
+func writeRPCError(rw http.ResponseWriter, err error) {
+	rerr := asRPCError(err)
+	log.Error(err)
+	if retryAfter, ok := rerr.Details["retry_after"].(int); ok {
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(rerr.status())
+	json.NewEncoder(rw).Encode(rerr)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+)
+
+func TestRPCErrorMapping(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		err       error
+		code      string
+		status    int
+		closeCode int
+		retryable bool
+	}{
+		{"bad request", rpcErrorf(codeBadRequest, "bad"), codeBadRequest, 400, websocket.CloseUnsupportedData, false},
+		{"unauthorized", rpcErrorf(codeUnauthorized, "who"), codeUnauthorized, 401, websocket.ClosePolicyViolation, false},
+		{"forbidden", rpcErrorf(codeForbidden, "no"), codeForbidden, 403, websocket.ClosePolicyViolation, false},
+		{"invalid params", rpcErrorf(codeInvalidParams, "uri"), codeInvalidParams, 422, websocket.CloseUnsupportedData, false},
+		{"router", rpcErrorf(codeRouter, "down"), codeRouter, 502, websocket.CloseTryAgainLater, true},
+		{"internal", rpcErrorf(codeInternal, "oops"), codeInternal, 500, websocket.CloseInternalServerErr, false},
+		{"plain error", errors.New("oops"), codeInternal, 500, websocket.CloseInternalServerErr, false},
+		{"wrapped", errors.Wrap(rpcErrorf(codeForbidden, "no"), "context"), codeForbidden, 403, websocket.ClosePolicyViolation, false},
+		{"rate limited", &limitError{msg: "slow down", retryAfter: 1500 * time.Millisecond}, codeRateLimited, 429, websocket.CloseTryAgainLater, true},
+		{"deadline", context.DeadlineExceeded, codeTimeout, 504, websocket.CloseTryAgainLater, true},
+		{"cancelled", errors.Wrap(context.Canceled, "call"), codeTimeout, 504, websocket.CloseTryAgainLater, true},
+	} {
+		rerr := asRPCError(test.err)
+		if rerr.Code != test.code || rerr.status() != test.status || rerr.closeCode() != test.closeCode || rerr.Retryable != test.retryable {
+			t.Errorf("%s: got code %s, status %d, close code %d, retryable %v; want %s, %d, %d, %v", test.name,
+				rerr.Code, rerr.status(), rerr.closeCode(), rerr.Retryable, test.code, test.status, test.closeCode, test.retryable)
+		}
+	}
+}
+
+func TestWriteRPCError(t *testing.T) {
+	rw := httptest.NewRecorder()
+	writeRPCError(rw, &limitError{msg: "Call rate limit exceeded", retryAfter: 1500 * time.Millisecond})
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "2" {
+		t.Errorf("got status %d, Retry-After %q", rw.Code, rw.Header().Get("Retry-After"))
+	}
+	var body rpcError
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Code != codeRateLimited || !body.Retryable || body.Details["retry_after"] != 2.0 {
+		t.Errorf("got %+v", body)
+	}
+}
+
+func TestCloseReason(t *testing.T) {
+	long := make([]byte, 500)
+	for i := range long {
+		long[i] = 'x'
+	}
+	for _, err := range []*rpcError{rpcErrorf(codeForbidden, "no"), rpcErrorf(codeInternal, "%s", long)} {
+		if reason := err.closeReason(); len(reason) > 123 {
+			t.Errorf("close reason of %d bytes", len(reason))
+		}
+	}
+	if reason := rpcErrorf(codeForbidden, "no").closeReason(); reason != "forbidden: no" {
+		t.Errorf("got close reason %q", reason)
+	}
+	// multi-byte runes are never split, wherever the limit falls
+	for pad := 0; pad < 4; pad++ {
+		msg := strings.Repeat("x", pad) + strings.Repeat("é€😀", 20)
+		reason := rpcErrorf(codeForbidden, "%s", msg).closeReason()
+		if len(reason) > 123 || len(reason) < 120 || !utf8.ValidString(reason) {
+			t.Errorf("got close reason of %d bytes, valid=%v", len(reason), utf8.ValidString(reason))
+		}
+	}
+}
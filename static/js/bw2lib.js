@@ -1,7 +1,22 @@
 var bw2lib = (function () {
+    // apps are served at the root of their own host or port, or under a path prefix
+    // (/a/<app>/) on a shared port; calls are made relative to that, whichever
+    // directory the current page is in
+    var prefix = window.location.pathname.match(/^\/a\/[^\/]+\//);
+    var basePath = prefix ? prefix[0] : "/";
+
+    // the key is optional: apps that have been granted permissions and are served on
+    // their own host or port are authorized by the proxy without the page holding a
+    // key. Failures of calls and subscriptions are passed {code, message, details, retryable}
     var Client = function(key) {
-        this.key = key;
+        this.key = key || "";
         this._subscriptions = {};
+        this._nextId = 0;
+    };
+
+    // headers for requests that carry the key outside of the body (config, storage)
+    Client.prototype._headers = function() {
+        return this.key ? {Authorization: "Bearer " + this.key} : {};
     };
 
     Client.prototype.query = function(params, success, failure) {
@@ -11,47 +26,293 @@ var bw2lib = (function () {
             params: params
         };
         console.log("QUERY",params);
-        $.post("/call", JSON.stringify(params))
+        $.post(basePath + "call", JSON.stringify(params))
             .done(function(data) {
                 success(data);
             })
             .fail(function(err) {
-                failure(err);
+                failure(err.responseJSON || err);
             });
     };
 
-    Client.prototype.publish = function(params, success, failure) {
+    // lists the URIs under params.uri that have persisted messages
+    Client.prototype.list = function(params, success, failure) {
         var params = {
             key: this.key,
-            proc: "publish",
+            proc: "list",
             params: params
         };
-        $.post("/call", JSON.stringify(params))
+        $.post(basePath + "call", JSON.stringify(params))
             .done(function(data) {
                 success(data);
             })
             .fail(function(err) {
-                failure(err);
+                failure(err.responseJSON || err);
             });
     };
 
-    Client.prototype.subscribe = function(params, success, failure) {
-        var ws = new WebSocket("ws://"+window.location.host+"/streaming");
+    Client.prototype.publish = function(params, success, failure) {
         var params = {
             key: this.key,
-            proc: "subscribe",
+            proc: "publish",
             params: params
         };
+        $.post(basePath + "call", JSON.stringify(params))
+            .done(function(data) {
+                success(data);
+            })
+            .fail(function(err) {
+                failure(err.responseJSON || err);
+            });
+    };
+
+    // runs several calls in one request. calls is a list of {proc, params}; success
+    // gets a list holding {result} or {error} for each call, in order
+    Client.prototype.batch = function(calls, success, failure) {
+        var key = this.key;
+        var batch = calls.map(function(call) {
+            return {key: key, proc: call.proc, params: call.params};
+        });
+        $.post(basePath + "call", JSON.stringify(batch))
+            .done(function(data) {
+                success(data);
+            })
+            .fail(function(err) {
+                failure(err.responseJSON || err);
+            });
+    };
+
+    // fetches the app's configuration, as set by the admin
+    Client.prototype.config = function(success, failure) {
+        $.ajax({url: basePath + "config", dataType: "json", headers: this._headers()})
+            .done(function(data) {
+                success(data);
+            })
+            .fail(function(err) {
+                failure(err.responseJSON || err);
+            });
+    };
+
+    // per-app key/value storage of JSON values, kept by the proxy
+    Client.prototype.storageGet = function(key, success, failure) {
+        $.ajax({url: basePath + "storage/" + encodeURIComponent(key), dataType: "json", headers: this._headers()})
+            .done(function(data) {
+                success(data);
+            })
+            .fail(function(err) {
+                failure(err.responseJSON || err);
+            });
+    };
+
+    Client.prototype.storagePut = function(key, value, success, failure) {
+        $.ajax({
+            url: basePath + "storage/" + encodeURIComponent(key),
+            method: "PUT",
+            contentType: "application/json",
+            headers: this._headers(),
+            data: JSON.stringify(value)
+        })
+            .done(function() {
+                success();
+            })
+            .fail(function(err) {
+                failure(err.responseJSON || err);
+            });
+    };
+
+    Client.prototype.storageDelete = function(key, success, failure) {
+        $.ajax({
+            url: basePath + "storage/" + encodeURIComponent(key),
+            method: "DELETE",
+            headers: this._headers()
+        })
+            .done(function() {
+                success();
+            })
+            .fail(function(err) {
+                failure(err.responseJSON || err);
+            });
+    };
+
+    // lists the stored keys starting with prefix
+    Client.prototype.storageList = function(prefix, success, failure) {
+        $.ajax({url: basePath + "storage", data: {prefix: prefix || ""}, dataType: "json", headers: this._headers()})
+            .done(function(data) {
+                success(data);
+            })
+            .fail(function(err) {
+                failure(err.responseJSON || err);
+            });
+    };
+
+    // all subscriptions share one websocket, opened on first use. Frames are tagged
+    // with the id of the subscription they belong to
+    Client.prototype._socket = function() {
+        if (this._ws) {
+            return this._ws;
+        }
+        var self = this;
+        var ws = new WebSocket("ws://"+window.location.host+basePath+"streaming");
+        this._ws = ws;
+        this._queue = [];
+        this._listCallbacks = [];
+        ws.onopen = function(e) {
+            self._opened = true;
+            self._queue.forEach(function(frame) {
+                ws.send(JSON.stringify(frame));
+            });
+            self._queue = [];
+        };
         ws.onmessage = function(e) {
-            success(JSON.parse(e.data));
+            var msg = JSON.parse(e.data);
+            if (msg.type == "list") {
+                var callback = self._listCallbacks.shift();
+                if (callback) {
+                    callback(msg.subscriptions || []);
+                }
+                return;
+            }
+            var sub = self._subscriptions[msg.id];
+            if (!sub) {
+                return;
+            }
+            if (msg.type == "message") {
+                sub.success(msg.data);
+            } else if (msg.type == "error") {
+                delete self._subscriptions[msg.id];
+                sub.failure(msg.error);
+            }
+        };
+        ws.onclose = function(e) {
+            if (!self._opened) {
+                // websockets are blocked (e.g. by a proxy): fall back to Server-Sent Events
+                self._ws = null;
+                self._useEvents = true;
+                for (var id in self._subscriptions) {
+                    self._subscribeEvents(id);
+                }
+                self._listCallbacks.forEach(function(callback) {
+                    callback(Object.keys(self._subscriptions));
+                });
+                return;
+            }
+            var subs = self._subscriptions;
+            self._ws = null;
+            self._subscriptions = {};
+            for (var id in subs) {
+                subs[id].failure({code: "closed", message: e.reason || "connection closed", retryable: true});
+            }
+        };
+        return ws;
+    };
+
+    Client.prototype._send = function(frame) {
+        var ws = this._socket();
+        if (ws.readyState == WebSocket.OPEN) {
+            ws.send(JSON.stringify(frame));
+        } else {
+            this._queue.push(frame);
         }
-        ws.onerror = function(e) {
-            failure(e.data)
+    };
+
+    // subscribes through an EventSource on "events"; the proxy resumes the stream
+    // from the last event received when it reconnects. The key is exchanged for a
+    // single use token first, so it never appears in the URL
+    Client.prototype._subscribeEvents = function(id, lastEventId) {
+        var self = this;
+        var sub = this._subscriptions[id];
+        var open = function(token) {
+            if (self._subscriptions[id] !== sub) {
+                // unsubscribed while waiting for the token
+                return;
+            }
+            var query = {uri: sub.params.uri || "", ponum: sub.params.ponum || ""};
+            if (token) {
+                query.token = token;
+            }
+            if (lastEventId) {
+                query.lastEventId = lastEventId;
+            }
+            var source = new EventSource(basePath + "events?" + $.param(query));
+            sub.source = source;
+            source.onmessage = function(e) {
+                lastEventId = e.lastEventId;
+                sub.success(JSON.parse(e.data));
+            };
+            source.addEventListener("failure", function(e) {
+                source.close();
+                delete self._subscriptions[id];
+                sub.failure(JSON.parse(e.data));
+            });
+            source.onerror = function(e) {
+                // EventSource gives up on HTTP errors, e.g. when the key is not allowed
+                if (source.readyState == EventSource.CLOSED) {
+                    delete self._subscriptions[id];
+                    sub.failure({code: "closed", message: "connection closed", retryable: false});
+                } else if (token) {
+                    // the token has been used: reconnect with a new one
+                    source.close();
+                    self._subscribeEvents(id, lastEventId);
+                }
+            };
+        };
+        if (!this.key) {
+            open("");
+            return;
         }
-        ws.onopen = function(e) {
-            console.log("OPEN")
-        ws.send(JSON.stringify(params));
+        $.post(basePath + "events", JSON.stringify({key: this.key}))
+            .done(function(data) {
+                open(data.token);
+            })
+            .fail(function(err) {
+                if (self._subscriptions[id] === sub) {
+                    delete self._subscriptions[id];
+                    sub.failure(err.responseJSON || err);
+                }
+            });
+    };
+
+    // subscribes to params.uri; returns the id of the subscription, which can be
+    // passed to unsubscribe. Subscriptions use a websocket, or Server-Sent Events
+    // if the websocket cannot be opened
+    Client.prototype.subscribe = function(params, success, failure) {
+        var id = "sub" + (this._nextId++);
+        this._subscriptions[id] = {success: success, failure: failure, params: params};
+        if (this._useEvents) {
+            this._subscribeEvents(id);
+            return id;
+        }
+        this._socket();
+        this._send({
+            op: "subscribe",
+            id: id,
+            key: this.key,
+            params: params
+        });
+        return id;
+    };
+
+    Client.prototype.unsubscribe = function(id) {
+        var sub = this._subscriptions[id];
+        delete this._subscriptions[id];
+        if (this._useEvents) {
+            if (sub && sub.source) {
+                sub.source.close();
+            }
+            return;
+        }
+        this._send({op: "unsubscribe", id: id});
+    };
+
+    // calls callback with the ids of the open subscriptions
+    Client.prototype.listSubscriptions = function(callback) {
+        if (this._useEvents) {
+            callback(Object.keys(this._subscriptions));
+            return;
         }
+        this._socket();
+        this._listCallbacks.push(callback);
+        this._send({op: "list"});
     };
 
     return {
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Each app gets a key/value store for JSON documents, kept in its own bucket inside
+// storageBucket. The size of an app's keys and values counts against StorageQuota
+var storageBucket = []byte("storage")
+
+// bytes used by each app's store
+var storageUsageBucket = []byte("storageusage")
+
+// longest key an app may use
+const maxStorageKeyLength = 1024
+
+type quotaError struct {
+	app   string
+	quota int64
+}
+
+func (e quotaError) Error() string {
+	return fmt.Sprintf("App %s would exceed its storage quota of %d bytes", e.app, e.quota)
+}
+
+func checkStorageKey(key string) error {
+	if key == "" {
+		return errors.New("Empty storage key")
+	}
+	if len(key) > maxStorageKeyLength {
+		return errors.Errorf("Storage key is longer than %d bytes", maxStorageKeyLength)
+	}
+	return nil
+}
+
+func storageUsage(tx *bolt.Tx, app string) int64 {
+	used, _ := strconv.ParseInt(string(tx.Bucket(storageUsageBucket).Get([]byte(app))), 10, 64)
+	return used
+}
+
+func setStorageUsage(tx *bolt.Tx, app string, used int64) error {
+	if used <= 0 {
+		return tx.Bucket(storageUsageBucket).Delete([]byte(app))
+	}
+	return tx.Bucket(storageUsageBucket).Put([]byte(app), []byte(strconv.FormatInt(used, 10)))
+}
+
+// returns the value stored under key in the app's store, or nil if there is none
+func (s *registry) getStorage(app, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storageBucket).Bucket([]byte(app))
+		if b == nil {
+			return nil
+		}
+		if v := b.Get([]byte(key)); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// stores the value under key in the app's store. Fails with a quotaError if the app
+// would use more than quota bytes (0 is unlimited)
+func (s *registry) putStorage(app, key string, value []byte, quota int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(storageBucket).CreateBucketIfNotExists([]byte(app))
+		if err != nil {
+			return err
+		}
+		used := storageUsage(tx, app)
+		if old := b.Get([]byte(key)); old != nil {
+			used -= int64(len(key) + len(old))
+		}
+		used += int64(len(key) + len(value))
+		if quota > 0 && used > quota {
+			return quotaError{app: app, quota: quota}
+		}
+		if err := b.Put([]byte(key), value); err != nil {
+			return err
+		}
+		return setStorageUsage(tx, app, used)
+	})
+}
+
+// removes key from the app's store; returns false if it was not there
+func (s *registry) deleteStorage(app, key string) (bool, error) {
+	var found bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storageBucket).Bucket([]byte(app))
+		if b == nil {
+			return nil
+		}
+		old := b.Get([]byte(key))
+		if old == nil {
+			return nil
+		}
+		found = true
+		used := storageUsage(tx, app) - int64(len(key)+len(old))
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+		return setStorageUsage(tx, app, used)
+	})
+	return found, err
+}
+
+// returns the keys in the app's store starting with prefix, in order
+func (s *registry) listStorage(app, prefix string) ([]string, error) {
+	keys := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storageBucket).Bucket([]byte(app))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// returns the app's whole store
+func (s *registry) exportStorage(app string) (map[string]json.RawMessage, error) {
+	values := make(map[string]json.RawMessage)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(storageBucket).Bucket([]byte(app))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			values[string(k)] = append(json.RawMessage{}, v...)
+			return nil
+		})
+	})
+	return values, err
+}
+
+// replaces the app's whole store with values
+func (s *registry) importStorage(app string, values map[string]json.RawMessage, quota int64) error {
+	var used int64
+	for key, value := range values {
+		if err := checkStorageKey(key); err != nil {
+			return err
+		}
+		if !json.Valid(value) {
+			return errors.Errorf("Value of %s is not valid JSON", key)
+		}
+		used += int64(len(key) + len(value))
+	}
+	if quota > 0 && used > quota {
+		return quotaError{app: app, quota: quota}
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		storage := tx.Bucket(storageBucket)
+		if storage.Bucket([]byte(app)) != nil {
+			if err := storage.DeleteBucket([]byte(app)); err != nil {
+				return err
+			}
+		}
+		b, err := storage.CreateBucket([]byte(app))
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			if err := b.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return setStorageUsage(tx, app, used)
+	})
+}
+
+func (s *registry) removeStorage(app string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(storageBucket).DeleteBucket([]byte(app)); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return setStorageUsage(tx, app, 0)
+	})
+}
+
+// lists the keys in the app's store, optionally only those starting with ?prefix=
+func (app *appServer) listStorage(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	keys, err := app.proxy.registry.listStorage(app.name, req.URL.Query().Get("prefix"))
+	if err != nil {
+		log.Error(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(keys)
+}
+
+func (app *appServer) getStorage(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	key := strings.TrimPrefix(ps.ByName("key"), "/")
+	value, err := app.proxy.registry.getStorage(app.name, key)
+	if err != nil {
+		log.Error(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if value == nil {
+		rw.WriteHeader(404)
+		rw.Write([]byte("No value stored for " + key))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(value)
+}
+
+// the request body is the JSON value to store
+func (app *appServer) putStorage(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	key := strings.TrimPrefix(ps.ByName("key"), "/")
+	if err := checkStorageKey(key); err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	var body io.Reader = req.Body
+	if quota := app.proxy.storageQuota; quota > 0 {
+		body = http.MaxBytesReader(rw, req.Body, quota)
+	}
+	value, err := ioutil.ReadAll(body)
+	if err != nil {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if !json.Valid(value) {
+		rw.WriteHeader(400)
+		rw.Write([]byte("Value is not valid JSON"))
+		return
+	}
+	err = app.proxy.registry.putStorage(app.name, key, value, app.proxy.storageQuota)
+	if _, overQuota := err.(quotaError); overQuota {
+		rw.WriteHeader(http.StatusRequestEntityTooLarge)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if err != nil {
+		log.Error(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (app *appServer) deleteStorage(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	key := strings.TrimPrefix(ps.ByName("key"), "/")
+	found, err := app.proxy.registry.deleteStorage(app.name, key)
+	if err != nil {
+		log.Error(err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	} else if !found {
+		rw.WriteHeader(404)
+		rw.Write([]byte("No value stored for " + key))
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// returns the app's store as a JSON object of keys to values
+func (srv *proxyServer) adminExportStorage(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	values, err := srv.registry.exportStorage(ps.ByName("name"))
+	if err != nil {
+		adminError(rw, 500, err)
+		return
+	}
+	adminJSON(rw, values)
+}
+
+// replaces the app's store with the JSON object of keys to values in the body
+func (srv *proxyServer) adminImportStorage(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	defer req.Body.Close()
+	name := ps.ByName("name")
+	if name == "" || badPathMatch.MatchString(name) {
+		adminError(rw, 400, errors.New("Invalid app name "+name))
+		return
+	}
+	var values map[string]json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&values); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	if err := srv.registry.importStorage(name, values, srv.storageQuota); err != nil {
+		adminError(rw, 400, err)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// writes the app's store to the given file, or stdout
+func exportStorage(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() < 1 {
+		log.Fatal("Need to specify app name")
+	}
+	body, err := adminRequest(cfg, "GET", "/api/apps/"+url.PathEscape(c.Args().Get(0))+"/storage", nil)
+	if err != nil {
+		return err
+	}
+	if filename := c.Args().Get(1); filename != "" {
+		return ioutil.WriteFile(filename, body, 0600)
+	}
+	_, err = os.Stdout.Write(body)
+	return err
+}
+
+// replaces the app's store with the contents of the given file
+func importStorage(c *cli.Context) error {
+	cfg := getConfig(c)
+	if c.NArg() != 2 {
+		log.Fatal("Need to specify app name and file")
+	}
+	name := c.Args().Get(0)
+	f, err := os.Open(c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := adminRequest(cfg, "PUT", "/api/apps/"+url.PathEscape(name)+"/storage", f); err != nil {
+		return err
+	}
+	fmt.Printf("Imported storage for %s\n", name)
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func usageOf(reg *registry, app string) (used int64) {
+	reg.db.View(func(tx *bolt.Tx) error {
+		used = storageUsage(tx, app)
+		return nil
+	})
+	return used
+}
+
+func TestStorageQuota(t *testing.T) {
+	reg := newTestRegistry(t)
+	for _, test := range []struct {
+		op    string
+		key   string
+		value string
+		// for deletes, whether the key was found
+		ok bool
+		// bytes used by the app afterwards
+		used int64
+	}{
+		{"put", "a", `"0123456789"`, true, 13},
+		{"put", "b", `[1, 2, 3]`, true, 23},
+		// overwriting only counts the difference
+		{"put", "a", `"01234567890123456789"`, true, 33},
+		{"put", "c", `"too much"`, false, 33},
+		{"delete", "b", "", true, 23},
+		{"put", "c", `"fits"`, true, 30},
+		{"delete", "missing", "", false, 30},
+		{"put", "a", `1`, true, 9},
+	} {
+		var ok bool
+		if test.op == "put" {
+			ok = reg.putStorage("demo", test.key, []byte(test.value), 40) == nil
+		} else {
+			found, err := reg.deleteStorage("demo", test.key)
+			ok = found && err == nil
+		}
+		if ok != test.ok {
+			t.Errorf("%s %s: ok=%v, want %v", test.op, test.key, ok, test.ok)
+		}
+		if used := usageOf(reg, "demo"); used != test.used {
+			t.Errorf("%s %s: %d bytes used, want %d", test.op, test.key, used, test.used)
+		}
+	}
+
+	// other apps have their own store and quota
+	if err := reg.putStorage("other", "a", []byte(`"0123456789012345678901234567890"`), 40); err != nil {
+		t.Error(err)
+	}
+	if value, _ := reg.getStorage("other", "c"); value != nil {
+		t.Errorf("other app sees %s", value)
+	}
+	if keys, _ := reg.listStorage("demo", ""); !reflect.DeepEqual(keys, []string{"a", "c"}) {
+		t.Errorf("got keys %v", keys)
+	}
+}
+
+func TestImportStorage(t *testing.T) {
+	reg := newTestRegistry(t)
+	reg.putStorage("demo", "old", []byte(`"old"`), 0)
+
+	decode := func(s string) map[string]json.RawMessage {
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(s), &values); err != nil {
+			t.Fatal(err)
+		}
+		return values
+	}
+	for _, test := range []struct {
+		name   string
+		values map[string]json.RawMessage
+		ok     bool
+	}{
+		{"invalid JSON", map[string]json.RawMessage{"a": json.RawMessage(`{`)}, false},
+		{"empty key", decode(`{"": 1}`), false},
+		{"long key", map[string]json.RawMessage{strings.Repeat("k", maxStorageKeyLength+1): json.RawMessage(`1`)}, false},
+		{"over quota", decode(`{"a": "0123456789012345678901234567890123456789"}`), false},
+	} {
+		if err := reg.importStorage("demo", test.values, 40); (err == nil) != test.ok {
+			t.Errorf("%s: %v, want ok=%v", test.name, err, test.ok)
+		}
+	}
+	// failed imports leave the store alone
+	if value, _ := reg.getStorage("demo", "old"); string(value) != `"old"` {
+		t.Errorf("store changed by a failed import: old = %s", value)
+	}
+
+	values := decode(`{"a": {"x": [1, 2]}, "b/c": "d"}`)
+	if err := reg.importStorage("demo", values, 40); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := reg.exportStorage("demo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(exported, values) {
+		t.Errorf("exported %v, want %v", exported, values)
+	}
+	if used := usageOf(reg, "demo"); used != int64(len(`a{"x": [1, 2]}b/c"d"`)) {
+		t.Errorf("%d bytes used after import", used)
+	}
+
+	if err := reg.removeStorage("demo"); err != nil {
+		t.Fatal(err)
+	}
+	if exported, _ := reg.exportStorage("demo"); len(exported) != 0 || usageOf(reg, "demo") != 0 {
+		t.Errorf("storage left after removal: %v", exported)
+	}
+}
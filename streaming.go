@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	bw2 "gopkg.in/immesys/bw2bind.v5"
+)
+
+// Protocol on /streaming: every frame sent by the client carries an op and, for
+// subscribe and unsubscribe, an id chosen by the client. Any number of subscriptions
+// can be open on one websocket:
+//
+//	{"op": "subscribe", "id": "a", "key": "...", "params": {"uri": "...", "ponum": "..."}}
+//	{"op": "unsubscribe", "id": "a"}
+//	{"op": "list"}
+//
+// The server answers with frames tagged by the subscription id:
+//
+//	{"id": "a", "type": "subscribed"}
+//	{"id": "a", "type": "message", "data": ...}
+//	{"id": "a", "type": "error", "error": {"code": "forbidden", "message": "...", "retryable": false}}
+//	{"id": "a", "type": "unsubscribed"}
+//	{"type": "list", "subscriptions": ["a"]}
+//
+// A subscription that fails gets an error frame and is closed; the others stay open.
+// A first frame without an op is a plain BWRPCCall: the socket then carries that
+// single subscription and its messages are sent untagged, as before. Its error is
+// sent as an rpcError message, followed by a close frame with a matching code
+const (
+	// largest frame accepted from the client
+	maxStreamFrameSize = 64 * 1024
+	// the client must answer pings within this time, or the socket is closed and its
+	// subscriptions cancelled
+	streamPongWait   = 60 * time.Second
+	streamPingPeriod = streamPongWait * 9 / 10
+	streamWriteWait  = 10 * time.Second
+)
+
+type streamFrame struct {
+	Op string `json:"op"`
+	ID string `json:"id"`
+	BWRPCCall
+}
+
+type streamMessage struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	Data          json.RawMessage `json:"data,omitempty"`
+	Error         *rpcError       `json:"error,omitempty"`
+	Subscriptions []string        `json:"subscriptions,omitempty"`
+}
+
+// the subscriptions open on one websocket
+type streamSession struct {
+	srv  *proxyServer
+	conn *websocket.Conn
+	ctx  context.Context
+	// gorilla/websocket allows only one concurrent writer
+	writeLock sync.Mutex
+	// the open subscriptions, by id
+	subscriptions map[string]*streamSubscription
+	sync.Mutex
+	// single untagged subscription (frames without an op)
+	legacy bool
+	// set once a close frame has been written
+	closeSent bool
+	wg        sync.WaitGroup
+}
+
+// one open subscription; ids can be reused once unsubscribed, so the entry is
+// compared by pointer before it is removed
+type streamSubscription struct {
+	cancel context.CancelFunc
+}
+
+func (srv *proxyServer) doStreamingCall(rw http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	c, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		log.Error(err)
+		return
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithCancel(req.Context())
+	session := &streamSession{
+		srv:           srv,
+		conn:          c,
+		ctx:           ctx,
+		subscriptions: make(map[string]*streamSubscription),
+	}
+
+	c.SetReadLimit(maxStreamFrameSize)
+	c.SetReadDeadline(time.Now().Add(streamPongWait))
+	c.SetPongHandler(func(string) error {
+		return c.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+	go session.keepalive()
+
+	err = session.serve()
+	// cancel the subscriptions and wait until they are torn down
+	cancel()
+	session.wg.Wait()
+
+	if _, closed := err.(*websocket.CloseError); closed {
+		// the client closed the socket; gorilla has already answered its close frame
+		return
+	}
+	if rerr, ok := err.(*rpcError); ok {
+		session.send(streamMessage{Type: "error", Error: rerr})
+		session.close(rerr.closeCode(), rerr.closeReason())
+		return
+	}
+	if req.Context().Err() != nil {
+		// the app or the server is shutting down
+		session.close(websocket.CloseGoingAway, "")
+		return
+	}
+	log.Warning(errors.Wrap(err, "Closing websocket"))
+	session.close(websocket.CloseInternalServerErr, "")
+}
+
+// pings the client until the session ends; a client that stops answering times out
+// the read in serve
+func (s *streamSession) keepalive() {
+	ticker := time.NewTicker(streamPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+				return
+			}
+		case <-s.ctx.Done():
+			// unblock serve
+			s.conn.SetReadDeadline(time.Now())
+			return
+		}
+	}
+}
+
+// writes a close frame, unless one has already been written
+func (s *streamSession) close(code int, reason string) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.closeLocked(code, reason)
+}
+
+func (s *streamSession) closeLocked(code int, reason string) error {
+	if s.closeSent {
+		return nil
+	}
+	s.closeSent = true
+	return s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+}
+
+// reads frames from the client until the socket is closed or fails, and returns
+// the error that ended it. An rpcError is a protocol error to report to the client
+func (s *streamSession) serve() error {
+	for first := true; ; first = false {
+		var frame streamFrame
+		_, r, err := s.conn.NextReader()
+		if err != nil {
+			return err
+		}
+		s.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+		if err := json.NewDecoder(r).Decode(&frame); err != nil {
+			rerr := newRPCError(codeBadRequest, err)
+			if s.legacy || first {
+				return rerr
+			}
+			s.send(streamMessage{Type: "error", Error: rerr})
+			continue
+		}
+
+		switch {
+		case frame.Op == "" && first:
+			s.legacy = true
+			s.subscribe("", frame.BWRPCCall)
+		case s.legacy:
+			return rpcErrorf(codeInvalidParams, "Only one call is allowed on this socket")
+		case frame.Op == "subscribe":
+			if frame.ID == "" {
+				s.send(streamMessage{Type: "error", Error: rpcErrorf(codeInvalidParams, "Subscriptions need an id")})
+				continue
+			}
+			frame.Proc = SUBSCRIBE
+			s.subscribe(frame.ID, frame.BWRPCCall)
+		case frame.Op == "unsubscribe":
+			s.unsubscribe(frame.ID)
+		case frame.Op == "list":
+			s.send(streamMessage{Type: "list", Subscriptions: s.list()})
+		default:
+			s.send(streamMessage{ID: frame.ID, Type: "error", Error: rpcErrorf(codeInvalidParams, "Unknown op %s", frame.Op)})
+		}
+	}
+}
+
+// writes the message to the websocket; in legacy mode only the data of messages is
+// sent, and an error closes the socket. If the write fails the connection is closed,
+// which ends the session
+func (s *streamSession) send(msg streamMessage) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+	var err error
+	switch {
+	case !s.legacy:
+		err = s.conn.WriteJSON(msg)
+	case msg.Type == "message":
+		err = s.conn.WriteMessage(websocket.TextMessage, msg.Data)
+	case msg.Type == "error":
+		if err = s.conn.WriteJSON(msg.Error); err == nil {
+			err = s.closeLocked(msg.Error.closeCode(), msg.Error.closeReason())
+		}
+	}
+	if err != nil {
+		log.Error(errors.Wrap(err, "Could not write to websocket"))
+		s.conn.Close()
+	}
+	return err
+}
+
+// returns the ids of the open subscriptions
+func (s *streamSession) list() []string {
+	s.Lock()
+	defer s.Unlock()
+	ids := []string{}
+	for id := range s.subscriptions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *streamSession) unsubscribe(id string) {
+	s.Lock()
+	sub, found := s.subscriptions[id]
+	delete(s.subscriptions, id)
+	s.Unlock()
+	if !found {
+		s.send(streamMessage{ID: id, Type: "error", Error: rpcErrorf(codeInvalidParams, "No subscription with id %s", id)})
+		return
+	}
+	sub.cancel()
+	s.send(streamMessage{ID: id, Type: "unsubscribed"})
+}
+
+// authorizes the call and starts forwarding its messages to the websocket
+func (s *streamSession) subscribe(id string, call BWRPCCall) {
+	fail := func(err error) {
+		log.Error(err)
+		s.send(streamMessage{ID: id, Type: "error", Error: asRPCError(err)})
+	}
+
+	permissions, err := s.srv.authorize(s.ctx, call.Key)
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := checkAppKey(s.ctx, permissions); err != nil {
+		fail(err)
+		return
+	}
+
+	// get the client for the vk
+	client := s.srv.registry.getClientForVK(permissions.VK)
+	if client == nil {
+		fail(noClientError())
+		return
+	}
+
+	if err := s.srv.usage.takeCall(permissions); err != nil {
+		auditor.record(s.ctx, permissions, call, time.Now(), auditOutcome(err), err)
+		fail(err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	sub := &streamSubscription{cancel: cancel}
+	s.Lock()
+	if _, found := s.subscriptions[id]; found {
+		s.Unlock()
+		cancel()
+		fail(rpcErrorf(codeInvalidParams, "Subscription %s already exists", id))
+		return
+	}
+	s.subscriptions[id] = sub
+	s.Unlock()
+
+	if call.Proc == SUBSCRIBE {
+		if err := s.srv.usage.openSubscription(permissions); err != nil {
+			auditor.record(s.ctx, permissions, call, time.Now(), auditOutcome(err), err)
+			s.end(id, sub)
+			fail(err)
+			return
+		}
+	}
+
+	s.send(streamMessage{ID: id, Type: "subscribed"})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if call.Proc == SUBSCRIBE {
+			defer s.srv.usage.closeSubscription(permissions)
+		}
+		if err := s.forward(ctx, id, client, permissions, call); err != nil && ctx.Err() == nil {
+			s.end(id, sub)
+			fail(err)
+		}
+	}()
+}
+
+// cancels the subscription and removes it if it is still the one registered under id
+func (s *streamSession) end(id string, sub *streamSubscription) {
+	sub.cancel()
+	s.Lock()
+	if s.subscriptions[id] == sub {
+		delete(s.subscriptions, id)
+	}
+	s.Unlock()
+}
+
+// sends the results of the call to the websocket until the subscription is cancelled
+// or fails
+func (s *streamSession) forward(ctx context.Context, id string, client *bw2.BW2Client, permissions Permissions, call BWRPCCall) error {
+	// close the subscription when the key stops being valid
+	var expired <-chan time.Time
+	if until := permissions.validUntil(time.Now()); !until.IsZero() {
+		expiry := time.NewTimer(time.Until(until))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+
+	respchan, errchan := doRPCStream(ctx, client, permissions, call)
+	for {
+		select {
+		case <-expired:
+			now := time.Now()
+			if err := permissions.checkValidAt(now); err != nil {
+				log.Warning("Closing subscription:", err)
+				return newRPCError(codeUnauthorized, err)
+			}
+			// moved into another window
+			if until := permissions.validUntil(now); !until.IsZero() {
+				expired = time.After(time.Until(until))
+			} else {
+				expired = nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errchan:
+			return err
+		case resp := <-respchan:
+			if err := s.send(streamMessage{ID: id, Type: "message", Data: resp}); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// opens a websocket to /streaming on the proxy
+func dialStreaming(t *testing.T, srv *proxyServer) *websocket.Conn {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		srv.doStreamingCall(rw, req, nil)
+	}))
+	t.Cleanup(server.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// a failing subscription or bad frame gets an error frame tagged with its id, and
+// the socket stays open for the others
+func TestStreamingFrames(t *testing.T) {
+	srv, keyA, _ := newTestProxy(t)
+	conn := dialStreaming(t, srv)
+
+	for _, test := range []struct {
+		name  string
+		frame string
+		// id, type and error code of the reply
+		id, typ, code string
+	}{
+		{"no id", `{"op": "subscribe", "key": "x", "params": {"uri": "a/b"}}`, "", "error", codeInvalidParams},
+		{"bad key", `{"op": "subscribe", "id": "a", "key": "x", "params": {"uri": "a/b"}}`, "a", "error", codeUnauthorized},
+		{"no key", `{"op": "subscribe", "id": "b", "params": {"uri": "a/b"}}`, "b", "error", codeUnauthorized},
+		// the test entity has no BOSSWAVE client
+		{"no client", `{"op": "subscribe", "id": "e", "key": "` + keyA + `", "params": {"uri": "a/b"}}`, "e", "error", codeRouter},
+		{"unknown op", `{"op": "publish", "id": "c"}`, "c", "error", codeInvalidParams},
+		{"not json", `{"op": `, "", "error", codeBadRequest},
+		{"unsubscribe unknown id", `{"op": "unsubscribe", "id": "d"}`, "d", "error", codeInvalidParams},
+		{"list", `{"op": "list"}`, "", "list", ""},
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(test.frame)); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		var msg streamMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		code := ""
+		if msg.Error != nil {
+			code = msg.Error.Code
+		}
+		if msg.ID != test.id || msg.Type != test.typ || code != test.code {
+			t.Errorf("%s: got %+v, want id %q, type %s, code %q", test.name, msg, test.id, test.typ, test.code)
+		}
+		if msg.Type == "list" && len(msg.Subscriptions) != 0 {
+			t.Errorf("%s: failed subscriptions left open: %v", test.name, msg.Subscriptions)
+		}
+	}
+}
+
+// a socket carrying a single untagged call reports its error as an rpcError, then
+// closes with a matching close code instead of writing to the hijacked connection
+func TestStreamingLegacyErrors(t *testing.T) {
+	srv, keyA, _ := newTestProxy(t)
+	for _, test := range []struct {
+		name   string
+		frames []string
+		code   string
+		close  int
+		// a first frame that can't be decoded could have been either kind, so its
+		// error is sent as an error frame
+		tagged bool
+	}{
+		{"not json", []string{`{"key": `}, codeBadRequest, websocket.CloseUnsupportedData, true},
+		{"bad key", []string{`{"key": "x", "proc": "subscribe", "params": {"uri": "a/b"}}`}, codeUnauthorized, websocket.ClosePolicyViolation, false},
+		{"no key", []string{`{"proc": "subscribe", "params": {"uri": "a/b"}}`}, codeUnauthorized, websocket.ClosePolicyViolation, false},
+		{"no client", []string{`{"key": "` + keyA + `", "proc": "subscribe", "params": {"uri": "a/b"}}`}, codeRouter, websocket.CloseTryAgainLater, false},
+	} {
+		conn := dialStreaming(t, srv)
+		for _, frame := range test.frames {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		var rerr rpcError
+		var err error
+		if test.tagged {
+			msg := streamMessage{Error: &rerr}
+			err = conn.ReadJSON(&msg)
+		} else {
+			err = conn.ReadJSON(&rerr)
+		}
+		if err != nil || rerr.Code != test.code {
+			t.Errorf("%s: got %+v, %v; want code %s", test.name, rerr, err, test.code)
+			continue
+		}
+		_, _, err = conn.ReadMessage()
+		if cerr, ok := err.(*websocket.CloseError); !ok || cerr.Code != test.close || !strings.HasPrefix(cerr.Text, test.code+": ") {
+			t.Errorf("%s: got %v, want close code %d", test.name, err, test.close)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"strconv"
@@ -35,6 +38,45 @@ func getBool(key string, m map[string]interface{}) bool {
 	return false
 }
 
+// generates a new random 256-bit API key
+func newAPIKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "Could not generate API key")
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "Could not generate salt")
+	}
+	return salt, nil
+}
+
+// the id of an API key is derived from the key, so we can find its record without
+// storing the key itself
+func apiKeyID(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:8])
+}
+
+// accepts either an API key or a key id and returns the key id
+func resolveKeyID(keyOrID string) string {
+	if len(keyOrID) == 64 {
+		return apiKeyID(keyOrID)
+	}
+	return keyOrID
+}
+
+func hashAPIKey(salt []byte, key string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(key))
+	return h.Sum(nil)
+}
+
 func isType(po, df string) bool {
 	parts := strings.SplitN(df, "/", 2)
 	var mask int
@@ -66,8 +108,6 @@ func po2iface(po bw2.PayloadObject) (interface{}, error) {
 		log.Error("Returning text for", po.GetPODotNum())
 		return po.TextRepresentation(), nil
 	}
-
-	return []byte{}, errors.New("Cannot unmarshal")
 }
 
 func iface2po(ponum string, v interface{}) (bw2.PayloadObject, error) {